@@ -0,0 +1,95 @@
+package harvester
+
+import (
+	"fmt"
+
+	harvsterv1 "github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
+	"github.com/rancher/machine/libmachine/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const defaultRemoveBackupTimeout = 3600 // in seconds
+
+// backupBeforeRemove creates a backup of the VM and waits for it to be ready,
+// so an accidentally removed machine can be restored. The backup is named
+// after the UID of the VM, so a retried Remove waits for the existing backup
+// instead of creating another one, while a later machine reusing the name
+// gets its own backup.
+func (d *Driver) backupBeforeRemove() error {
+	vm, err := d.getVM()
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if err = d.checkRemovableVM(vm); err != nil {
+		return err
+	}
+
+	backup := d.buildRemovalBackup(vm)
+	log.Infof("Creating %s %s of machine %s before removing it", backup.Spec.Type, backup.Name, d.MachineName)
+	if _, err = d.createBackup(backup); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	c, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	var backupErr error
+	ready := func() (bool, error) {
+		backup, err := d.getBackup(backup.Name)
+		if err != nil {
+			return false, err
+		}
+		if backup.Status.Error != nil && backup.Status.Error.Message != nil {
+			backupErr = fmt.Errorf("%s %s of machine %s failed: %s", backup.Spec.Type, backup.Name, d.MachineName, *backup.Status.Error.Message)
+			return true, nil
+		}
+		return ptr.Deref(backup.Status.ReadyToUse, false), nil
+	}
+	log.Debugf("Waiting for node backup ready")
+	if err = d.waitForTargets(fmt.Sprintf("%s %s ready", backup.Spec.Type, backup.Name), ready, []watchTarget{
+		{kind: "backup", name: backup.Name, watchFn: c.HarvesterClient.HarvesterhciV1beta1().VirtualMachineBackups(d.VMNamespace).Watch},
+	}); err != nil {
+		return err
+	}
+	return backupErr
+}
+
+func (d *Driver) buildRemovalBackup(vm *kubevirtv1.VirtualMachine) *harvsterv1.VirtualMachineBackup {
+	backupLabels := map[string]string{}
+	for _, key := range []string{clusterNameLabelKey, poolNameLabelKey, machineSetNameLabelKey} {
+		if value, ok := vm.Labels[key]; ok {
+			backupLabels[key] = value
+		}
+	}
+	return &harvsterv1.VirtualMachineBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      removalBackupName(vm),
+			Namespace: d.VMNamespace,
+			Labels:    backupLabels,
+		},
+		Spec: harvsterv1.VirtualMachineBackupSpec{
+			Source: corev1.TypedLocalObjectReference{
+				APIGroup: ptr.To(kubevirtv1.GroupVersion.Group),
+				Kind:     kubevirtv1.VirtualMachineGroupVersionKind.Kind,
+				Name:     vm.Name,
+			},
+			Type: harvsterv1.BackupType(d.RemoveBackupType),
+		},
+	}
+}
+
+func removalBackupName(vm *kubevirtv1.VirtualMachine) string {
+	uid := string(vm.UID)
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+	return fmt.Sprintf("%s-before-removal-%s", vm.Name, uid)
+}
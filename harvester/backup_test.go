@@ -0,0 +1,52 @@
+package harvester
+
+import (
+	"testing"
+
+	harvsterv1 "github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func TestBuildRemovalBackup(t *testing.T) {
+	d := NewDriver("test-cluster-pool1-abcde-fghij", "")
+	d.VMNamespace = "default"
+	d.RemoveBackupType = string(harvsterv1.Backup)
+	vm := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: d.MachineName,
+			UID:  "0b5c3a2e-7d1f-4c8e-9a6b-2f4d8e1c7a93",
+			Labels: map[string]string{
+				clusterNameLabelKey: "test-cluster",
+				poolNameLabelKey:    "pool1",
+				"unrelated":         "label",
+			},
+		},
+	}
+
+	backup := d.buildRemovalBackup(vm)
+	require.Equal(t, "test-cluster-pool1-abcde-fghij-before-removal-0b5c3a2e", backup.Name)
+	require.Equal(t, "default", backup.Namespace)
+	require.Equal(t, map[string]string{
+		clusterNameLabelKey: "test-cluster",
+		poolNameLabelKey:    "pool1",
+	}, backup.Labels)
+	require.Equal(t, harvsterv1.Backup, backup.Spec.Type)
+	require.Equal(t, "VirtualMachine", backup.Spec.Source.Kind)
+	require.Equal(t, "kubevirt.io", *backup.Spec.Source.APIGroup)
+	require.Equal(t, d.MachineName, backup.Spec.Source.Name)
+}
+
+func TestRemovalBackupNameOfReusedMachineName(t *testing.T) {
+	vm := &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: "test-machine", UID: "0b5c3a2e-7d1f-4c8e-9a6b-2f4d8e1c7a93"}}
+	recreated := &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: "test-machine", UID: "5e9f0c1d-2b3a-4d6e-8f7a-1c2b3d4e5f60"}}
+	require.Equal(t, removalBackupName(vm), removalBackupName(vm.DeepCopy()))
+	require.NotEqual(t, removalBackupName(vm), removalBackupName(recreated))
+}
+
+func TestCheckRemoveBackupType(t *testing.T) {
+	d := NewDriver("test-machine", "")
+	d.RemoveBackupType = string(harvsterv1.Snapshot)
+	require.EqualError(t, d.checkConfig(), `invalid remove backup type "snapshot", snapshots are removed with the machine, use "backup"`)
+}
@@ -0,0 +1,132 @@
+package harvester
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/rancher/machine/libmachine/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	harvesterutil "github.com/harvester/harvester/pkg/util"
+)
+
+const defaultRemoveCleanupTimeout = 120 // in seconds
+
+// dependentObject is an object expected to be garbage collected with the VM.
+type dependentObject struct {
+	watchTarget
+	exists func() (bool, error)
+}
+
+// removalDependents returns the existing volumes, data volumes and secrets
+// which should be deleted with vm, based on the removed PVCs annotation of vm.
+func (d *Driver) removalDependents(vm *kubevirtv1.VirtualMachine) ([]dependentObject, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	existsFunc := func(get func() error) func() (bool, error) {
+		return func() (bool, error) {
+			if err := get(); err != nil {
+				if apierrors.IsNotFound(err) {
+					return false, nil
+				}
+				return false, err
+			}
+			return true, nil
+		}
+	}
+
+	var candidates []dependentObject
+	pvcs := c.KubeClient.CoreV1().PersistentVolumeClaims(d.VMNamespace)
+	dataVolumes := c.DynamicClient.Resource(dataVolumeResource).Namespace(d.VMNamespace)
+	for _, claimName := range strings.Split(vm.Annotations[harvesterutil.RemovedPVCsAnnotationKey], ",") {
+		if claimName == "" {
+			continue
+		}
+		// a claim populated by CDI is owned by a DataVolume of the same name,
+		// which keeps it from being collected until it is deleted as well
+		candidates = append(candidates, dependentObject{
+			watchTarget: watchTarget{kind: "pvc", name: claimName, watchFn: pvcs.Watch},
+			exists: existsFunc(func() error {
+				_, err := pvcs.Get(d.ctx, claimName, metav1.GetOptions{})
+				return err
+			}),
+		}, dependentObject{
+			watchTarget: watchTarget{kind: "datavolume", name: claimName, watchFn: dataVolumes.Watch},
+			exists: existsFunc(func() error {
+				_, err := dataVolumes.Get(d.ctx, claimName, metav1.GetOptions{})
+				return err
+			}),
+		})
+	}
+	secrets := c.KubeClient.CoreV1().Secrets(d.VMNamespace)
+	for _, secretName := range []string{d.cloudInitSecretName(), d.sshKeySecretName()} {
+		candidates = append(candidates, dependentObject{
+			watchTarget: watchTarget{kind: "secret", name: secretName, watchFn: secrets.Watch},
+			exists: existsFunc(func() error {
+				_, err := secrets.Get(d.ctx, secretName, metav1.GetOptions{})
+				return err
+			}),
+		})
+	}
+
+	dependents := make([]dependentObject, 0, len(candidates))
+	for _, candidate := range candidates {
+		exists, err := candidate.exists()
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			dependents = append(dependents, candidate)
+		}
+	}
+	return dependents, nil
+}
+
+// waitDependentsRemoved waits up to RemoveCleanupTimeout seconds for the
+// dependents of a removed VM to be garbage collected, and returns those left
+// behind. They are only reported as a warning, since the machine itself is
+// gone and a retried Remove would find nothing to clean up.
+func (d *Driver) waitDependentsRemoved(dependents []dependentObject) []string {
+	if len(dependents) == 0 {
+		return nil
+	}
+	targets := make([]watchTarget, 0, len(dependents))
+	for _, dependent := range dependents {
+		targets = append(targets, dependent.watchTarget)
+	}
+
+	var orphans []string
+	removed := func() (bool, error) {
+		orphans = orphans[:0]
+		var lastErr error
+		for _, dependent := range dependents {
+			exists, err := dependent.exists()
+			if err != nil {
+				lastErr = err
+			}
+			if exists || err != nil {
+				orphans = append(orphans, fmt.Sprintf("%s %s/%s", dependent.kind, d.VMNamespace, dependent.name))
+			}
+		}
+		return len(orphans) == 0, lastErr
+	}
+
+	timeout := d.RemoveCleanupTimeout
+	if timeout <= 0 {
+		timeout = defaultRemoveCleanupTimeout
+	}
+	log.Debugf("Waiting for volumes and secrets of node removed")
+	err := d.withTimeout("clean up", timeout, func() error {
+		return d.waitForTargets("volumes and secrets removed", removed, targets)
+	})
+	if err != nil {
+		log.Warnf("Machine %s was removed, but these resources were not cleaned up: %s (%v)", d.MachineName, strings.Join(orphans, ", "), err)
+		return slices.Clone(orphans)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package harvester
+
+import (
+	"testing"
+
+	harvesterutil "github.com/harvester/harvester/pkg/util"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func newDataVolume(name string) *unstructured.Unstructured {
+	dataVolume := &unstructured.Unstructured{}
+	dataVolume.SetAPIVersion(dataVolumeResource.GroupVersion().String())
+	dataVolume.SetKind("DataVolume")
+	dataVolume.SetNamespace(defaultNamespace)
+	dataVolume.SetName(name)
+	return dataVolume
+}
+
+func TestRemovalDependents(t *testing.T) {
+	vm := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-machine",
+			Namespace:   defaultNamespace,
+			Annotations: map[string]string{harvesterutil.RemovedPVCsAnnotationKey: "test-machine-disk-0,test-machine-disk-1"},
+		},
+	}
+	d, _, _ := newFakeDriver(
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "test-machine-disk-0", Namespace: defaultNamespace}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "test-machine-cloudinit", Namespace: defaultNamespace}},
+		newDataVolume("test-machine-disk-1"),
+	)
+
+	dependents, err := d.removalDependents(vm)
+	require.NoError(t, err)
+	var names []string
+	for _, dependent := range dependents {
+		names = append(names, dependent.kind+" "+dependent.name)
+	}
+	require.Equal(t, []string{
+		"pvc test-machine-disk-0",
+		"datavolume test-machine-disk-1",
+		"secret test-machine-cloudinit",
+	}, names)
+}
+
+func TestWaitDependentsRemoved(t *testing.T) {
+	vm := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-machine",
+			Namespace:   defaultNamespace,
+			Annotations: map[string]string{harvesterutil.RemovedPVCsAnnotationKey: "test-machine-disk-0"},
+		},
+	}
+	d, kubeClient, _ := newFakeDriver(
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "test-machine-disk-0", Namespace: defaultNamespace}},
+		newDataVolume("test-machine-disk-0"),
+	)
+	d.RemoveCleanupTimeout = 1
+	dependents, err := d.removalDependents(vm)
+	require.NoError(t, err)
+
+	orphans := d.waitDependentsRemoved(dependents)
+	require.Equal(t, []string{"pvc default/test-machine-disk-0", "datavolume default/test-machine-disk-0"}, orphans)
+
+	require.NoError(t, kubeClient.CoreV1().PersistentVolumeClaims(defaultNamespace).Delete(d.ctx, "test-machine-disk-0", metav1.DeleteOptions{}))
+	require.NoError(t, d.client.DynamicClient.Resource(dataVolumeResource).Namespace(defaultNamespace).Delete(d.ctx, "test-machine-disk-0", metav1.DeleteOptions{}))
+	require.Empty(t, d.waitDependentsRemoved(dependents))
+}
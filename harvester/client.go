@@ -1,6 +1,7 @@
 package harvester
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
@@ -13,11 +14,15 @@ import (
 	"github.com/rancher/wrangler/pkg/kubeconfig"
 	corev1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/utils/ptr"
 	kubevirtv1 "kubevirt.io/api/core/v1"
 
 	harvesterutil "github.com/harvester/harvester/pkg/util"
@@ -26,10 +31,15 @@ import (
 type Client struct {
 	RestConfig                *rest.Config
 	KubeVirtSubresourceClient *rest.RESTClient
-	HarvesterClient           *harvclient.Clientset
-	KubeClient                *kubernetes.Clientset
+	HarvesterClient           harvclient.Interface
+	KubeClient                kubernetes.Interface
+	DynamicClient             dynamic.Interface
 }
 
+// dataVolumeResource is served through the dynamic client, since the
+// generated harvester client treats data volumes as cluster scoped.
+var dataVolumeResource = schema.GroupVersionResource{Group: "cdi.kubevirt.io", Version: "v1beta1", Resource: "datavolumes"}
+
 func NewClientFromRestConfig(restConfig *rest.Config) (*Client, error) {
 	subresourceConfig := rest.CopyConfig(restConfig)
 	subresourceConfig.GroupVersion = &schema.GroupVersion{Group: kubevirtv1.SubresourceGroupName, Version: kubevirtv1.ApiLatestVersion}
@@ -47,11 +57,16 @@ func NewClientFromRestConfig(restConfig *rest.Config) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
 	return &Client{
 		RestConfig:                restConfig,
 		KubeVirtSubresourceClient: kubeVirtSubresourceClient,
 		HarvesterClient:           harvClient,
 		KubeClient:                kubeClient,
+		DynamicClient:             dynamicClient,
 	}, nil
 }
 
@@ -154,6 +169,42 @@ func (d *Driver) getNetwork(networkName string) (*cniv1.NetworkAttachmentDefinit
 	return c.HarvesterClient.K8sCniCncfIoV1().NetworkAttachmentDefinitions(namespace).Get(d.ctx, name, metav1.GetOptions{})
 }
 
+func (d *Driver) getTemplate(templateName string) (*harvsterv1.VirtualMachineTemplate, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	namespace, name, err := NamespacedNamePartsByDefault(templateName, d.VMNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return c.HarvesterClient.HarvesterhciV1beta1().VirtualMachineTemplates(namespace).Get(d.ctx, name, metav1.GetOptions{})
+}
+
+func (d *Driver) getTemplateVersion(namespace, name string) (*harvsterv1.VirtualMachineTemplateVersion, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.HarvesterClient.HarvesterhciV1beta1().VirtualMachineTemplateVersions(namespace).Get(d.ctx, name, metav1.GetOptions{})
+}
+
+func (d *Driver) listTemplateVersions(namespace string) (*harvsterv1.VirtualMachineTemplateVersionList, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.HarvesterClient.HarvesterhciV1beta1().VirtualMachineTemplateVersions(namespace).List(d.ctx, metav1.ListOptions{})
+}
+
+func (d *Driver) getSecret(namespace, name string) (*corev1.Secret, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.KubeClient.CoreV1().Secrets(namespace).Get(d.ctx, name, metav1.GetOptions{})
+}
+
 func (d *Driver) getVMI() (*kubevirtv1.VirtualMachineInstance, error) {
 	c, err := d.getClient()
 	if err != nil {
@@ -178,7 +229,23 @@ func (d *Driver) updateVM(newVM *kubevirtv1.VirtualMachine) (*kubevirtv1.Virtual
 	return c.HarvesterClient.KubevirtV1().VirtualMachines(d.VMNamespace).Update(d.ctx, newVM, metav1.UpdateOptions{})
 }
 
-func (d *Driver) patchRemovedPVCs(vm *kubevirtv1.VirtualMachine) (*kubevirtv1.VirtualMachine, error) {
+func (d *Driver) patchVMAnnotations(annotations map[string]string) (*kubevirtv1.VirtualMachine, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.HarvesterClient.KubevirtV1().VirtualMachines(d.VMNamespace).Patch(d.ctx, d.MachineName, types.MergePatchType, patch, metav1.PatchOptions{})
+}
+
+func (d *Driver) patchRemovedPVCs(vm *kubevirtv1.VirtualMachine, hotplugged, retained map[string]string) (*kubevirtv1.VirtualMachine, error) {
 	removeAll := false
 	if value, ok := vm.Annotations[removeAllPVCsAnnotationKey]; ok && value == "true" {
 		log.Debugf("Force the removal of all persistent volume claims")
@@ -187,10 +254,16 @@ func (d *Driver) patchRemovedPVCs(vm *kubevirtv1.VirtualMachine) (*kubevirtv1.Vi
 
 	removedPVCs := make(map[string]struct{})
 	for _, volume := range vm.Spec.Template.Spec.Volumes {
-		if volume.PersistentVolumeClaim == nil || (!removeAll && volume.PersistentVolumeClaim.Hotpluggable) {
+		if volume.PersistentVolumeClaim == nil {
 			continue
 		}
-		removedPVCs[volume.PersistentVolumeClaim.ClaimName] = struct{}{}
+		claimName := volume.PersistentVolumeClaim.ClaimName
+		// volumes hotplugged by other means than AddVolume are not the
+		// machine's to delete
+		if _, ok := hotplugged[claimName]; !ok && !removeAll && volume.PersistentVolumeClaim.Hotpluggable {
+			continue
+		}
+		removedPVCs[claimName] = struct{}{}
 	}
 
 	if removeAll {
@@ -198,8 +271,9 @@ func (d *Driver) patchRemovedPVCs(vm *kubevirtv1.VirtualMachine) (*kubevirtv1.Vi
 		if err != nil {
 			return nil, err
 		}
+		// volumes retained from removed machines are kept
 		pvcList, err := c.KubeClient.CoreV1().PersistentVolumeClaims(d.VMNamespace).List(d.ctx, metav1.ListOptions{
-			LabelSelector: fmt.Sprintf("%s=%s", clusterNameLabelKey, d.ClusterName),
+			LabelSelector: fmt.Sprintf("%s=%s,!%s", clusterNameLabelKey, d.ClusterName, retainedFromMachineLabelKey),
 		})
 		if err != nil {
 			return nil, err
@@ -210,12 +284,17 @@ func (d *Driver) patchRemovedPVCs(vm *kubevirtv1.VirtualMachine) (*kubevirtv1.Vi
 		}
 	}
 
+	for claimName := range retained {
+		delete(removedPVCs, claimName)
+	}
+
 	keys := make([]string, 0, len(removedPVCs))
 	for key := range removedPVCs {
 		keys = append(keys, key)
 	}
 	vmCopy := vm.DeepCopy()
 	vmCopy.Annotations[harvesterutil.RemovedPVCsAnnotationKey] = strings.Join(keys, ",")
+	detachRetainedVolumes(vmCopy, retained)
 	return d.updateVM(vmCopy)
 }
 
@@ -238,6 +317,71 @@ func (d *Driver) putVMSubResource(subResource string) error {
 	return c.KubeVirtSubresourceClient.Put().Namespace(d.VMNamespace).Resource(vmResource).SubResource(subResource).Name(d.MachineName).Do(d.ctx).Error()
 }
 
+func (d *Driver) putVMISubResource(subResource string) error {
+	c, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	return c.KubeVirtSubresourceClient.Put().Namespace(d.VMNamespace).Resource(vmiResource).SubResource(subResource).Name(d.MachineName).Do(d.ctx).Error()
+}
+
+// forceStopVM stops the VM with a zero grace period, so the guest is powered
+// off immediately instead of being asked to shut down.
+func (d *Driver) forceStopVM() error {
+	return d.stopVMWithGracePeriod(0)
+}
+
+// stopVMWithGracePeriod stops the VM, giving the guest gracePeriod seconds to
+// shut down before it is powered off.
+func (d *Driver) stopVMWithGracePeriod(gracePeriod int64) error {
+	c, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(&kubevirtv1.StopOptions{GracePeriod: ptr.To(gracePeriod)})
+	if err != nil {
+		return err
+	}
+	return c.KubeVirtSubresourceClient.Put().Namespace(d.VMNamespace).Resource(vmResource).SubResource(actionStop).Name(d.MachineName).Body(body).Do(d.ctx).Error()
+}
+
+// addVolumeToVM hotplugs the volume described by options into the VM.
+func (d *Driver) addVolumeToVM(options *kubevirtv1.AddVolumeOptions) error {
+	c, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	return c.KubeVirtSubresourceClient.Put().Namespace(d.VMNamespace).Resource(vmResource).SubResource(actionAddVolume).Name(d.MachineName).Body(body).Do(d.ctx).Error()
+}
+
+// removeVolumeFromVM detaches the hotplugged volume with the given name from
+// the VM.
+func (d *Driver) removeVolumeFromVM(name string) error {
+	c, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(&kubevirtv1.RemoveVolumeOptions{Name: name})
+	if err != nil {
+		return err
+	}
+	return c.KubeVirtSubresourceClient.Put().Namespace(d.VMNamespace).Resource(vmResource).SubResource(actionRemoveVolume).Name(d.MachineName).Body(body).Do(d.ctx).Error()
+}
+
+func (d *Driver) forceDeleteVMI() error {
+	c, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	return c.HarvesterClient.KubevirtV1().VirtualMachineInstances(d.VMNamespace).Delete(d.ctx, d.MachineName, metav1.DeleteOptions{
+		GracePeriodSeconds: ptr.To[int64](0),
+	})
+}
+
 func (d *Driver) createVM(vm *kubevirtv1.VirtualMachine) (*kubevirtv1.VirtualMachine, error) {
 	c, err := d.getClient()
 	if err != nil {
@@ -253,3 +397,110 @@ func (d *Driver) createSecret(secret *corev1.Secret) (*corev1.Secret, error) {
 	}
 	return c.KubeClient.CoreV1().Secrets(d.VMNamespace).Create(d.ctx, secret, metav1.CreateOptions{})
 }
+
+func (d *Driver) updateSecret(secret *corev1.Secret) (*corev1.Secret, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.KubeClient.CoreV1().Secrets(d.VMNamespace).Update(d.ctx, secret, metav1.UpdateOptions{})
+}
+
+func (d *Driver) deleteSecret(name string) error {
+	c, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	return c.KubeClient.CoreV1().Secrets(d.VMNamespace).Delete(d.ctx, name, metav1.DeleteOptions{})
+}
+
+func (d *Driver) getPVC(name string) (*corev1.PersistentVolumeClaim, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.KubeClient.CoreV1().PersistentVolumeClaims(d.VMNamespace).Get(d.ctx, name, metav1.GetOptions{})
+}
+
+func (d *Driver) createPVC(pvc *corev1.PersistentVolumeClaim) (*corev1.PersistentVolumeClaim, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.KubeClient.CoreV1().PersistentVolumeClaims(d.VMNamespace).Create(d.ctx, pvc, metav1.CreateOptions{})
+}
+
+func (d *Driver) deletePVC(name string) error {
+	c, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	return c.KubeClient.CoreV1().PersistentVolumeClaims(d.VMNamespace).Delete(d.ctx, name, metav1.DeleteOptions{})
+}
+
+// patchPVCSize requests the claim with the given name to be resized.
+func (d *Driver) patchPVCSize(name string, size resource.Quantity) (*corev1.PersistentVolumeClaim, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"resources": map[string]interface{}{
+				"requests": corev1.ResourceList{corev1.ResourceStorage: size},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.KubeClient.CoreV1().PersistentVolumeClaims(d.VMNamespace).Patch(d.ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+}
+
+func (d *Driver) listResourceQuotas() (*corev1.ResourceQuotaList, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.KubeClient.CoreV1().ResourceQuotas(d.VMNamespace).List(d.ctx, metav1.ListOptions{})
+}
+
+func (d *Driver) createMigration(migration *kubevirtv1.VirtualMachineInstanceMigration) (*kubevirtv1.VirtualMachineInstanceMigration, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.HarvesterClient.KubevirtV1().VirtualMachineInstanceMigrations(d.VMNamespace).Create(d.ctx, migration, metav1.CreateOptions{})
+}
+
+func (d *Driver) getMigration(name string) (*kubevirtv1.VirtualMachineInstanceMigration, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.HarvesterClient.KubevirtV1().VirtualMachineInstanceMigrations(d.VMNamespace).Get(d.ctx, name, metav1.GetOptions{})
+}
+
+func (d *Driver) deleteMigration(name string) error {
+	c, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	return c.HarvesterClient.KubevirtV1().VirtualMachineInstanceMigrations(d.VMNamespace).Delete(d.ctx, name, metav1.DeleteOptions{})
+}
+
+func (d *Driver) createBackup(backup *harvsterv1.VirtualMachineBackup) (*harvsterv1.VirtualMachineBackup, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.HarvesterClient.HarvesterhciV1beta1().VirtualMachineBackups(d.VMNamespace).Create(d.ctx, backup, metav1.CreateOptions{})
+}
+
+func (d *Driver) getBackup(name string) (*harvsterv1.VirtualMachineBackup, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.HarvesterClient.HarvesterhciV1beta1().VirtualMachineBackups(d.VMNamespace).Get(d.ctx, name, metav1.GetOptions{})
+}
@@ -0,0 +1,45 @@
+package harvester
+
+import (
+	"reflect"
+	"strings"
+
+	harvfake "github.com/harvester/harvester/pkg/generated/clientset/versioned/fake"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+// newFakeDriver returns a driver of the machine test-machine in the default
+// namespace, whose client serves objects from fake clientsets. Unstructured
+// objects are served by the dynamic client.
+func newFakeDriver(objects ...runtime.Object) (*Driver, *kubefake.Clientset, *harvfake.Clientset) {
+	var kubeObjects, harvesterObjects, dynamicObjects []runtime.Object
+	for _, object := range objects {
+		// both schemes know the core types, so they are told apart by package
+		switch {
+		case strings.HasPrefix(reflect.TypeOf(object).Elem().PkgPath(), "k8s.io/api/"):
+			kubeObjects = append(kubeObjects, object)
+		case reflect.TypeOf(object) == reflect.TypeOf(&unstructured.Unstructured{}):
+			dynamicObjects = append(dynamicObjects, object)
+		default:
+			harvesterObjects = append(harvesterObjects, object)
+		}
+	}
+	kubeClient := kubefake.NewSimpleClientset(kubeObjects...)
+	harvesterClient := harvfake.NewSimpleClientset(harvesterObjects...)
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		dataVolumeResource: "DataVolumeList",
+	}, dynamicObjects...)
+
+	d := NewDriver("test-machine", "")
+	d.VMNamespace = defaultNamespace
+	d.client = &Client{
+		KubeClient:      kubeClient,
+		HarvesterClient: harvesterClient,
+		DynamicClient:   dynamicClient,
+	}
+	return d, kubeClient, harvesterClient
+}
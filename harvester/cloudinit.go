@@ -57,7 +57,7 @@ func (d *Driver) buildCloudInit() (*builder.CloudInitSource, *corev1.Secret, err
 	}
 	cloudConfigSecret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("%s-%s", d.MachineName, "cloudinit"),
+			Name:      d.cloudInitSecretName(),
 			Namespace: d.VMNamespace,
 		},
 		Data: map[string][]byte{},
@@ -84,6 +84,10 @@ func (d *Driver) buildCloudInit() (*builder.CloudInitSource, *corev1.Secret, err
 	return cloudInitSource, cloudConfigSecret, nil
 }
 
+func (d *Driver) cloudInitSecretName() string {
+	return fmt.Sprintf("%s-%s", d.MachineName, "cloudinit")
+}
+
 func (d *Driver) mergeCloudInit() (string, string, error) {
 	var (
 		userData    string
@@ -0,0 +1,233 @@
+package harvester
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const storagePathEnvKey = "MACHINE_STORAGE_PATH"
+
+// command is an operation on an existing machine which is not part of
+// drivers.Driver, so rancher-machine cannot call it through the plugin. It is
+// run as a subcommand of the driver binary against the machine store.
+type command struct {
+	usage string
+	// flags defines the options of the command and returns the operation,
+	// which is run once they are parsed and prints its result to output
+	flags func(fs *flag.FlagSet, output io.Writer) func(d *Driver) error
+}
+
+var commands = map[string]command{
+	"add-volume": {
+		usage: "create a volume and hotplug it into the machine as a new disk",
+		flags: func(fs *flag.FlagSet, output io.Writer) func(d *Driver) error {
+			var disk Disk
+			fs.StringVar(&disk.ImageName, "image-name", "", "image of the volume, as namespace/name or name in the machine namespace")
+			fs.StringVar(&disk.StorageClassName, "storage-class-name", "", "storage class of an empty volume")
+			fs.IntVar(&disk.Size, "size", 0, "size of the volume in GiB")
+			fs.StringVar(&disk.Bus, "bus", hotplugDiskBus, "bus of the disk, scsi or virtio")
+			fs.StringVar(&disk.RetainPolicy, "retain-policy", "", "delete or retain the volume when the machine is removed, defaults to the disk retain policy of the machine")
+			return func(d *Driver) error {
+				diskName, err := d.AddVolume(disk)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(output, "%s\n", diskName)
+				return nil
+			}
+		},
+	},
+	"pause": {
+		usage: "freeze the machine, keeping its memory state",
+		flags: func(*flag.FlagSet, io.Writer) func(d *Driver) error {
+			return (*Driver).Pause
+		},
+	},
+	"expand-disk": {
+		usage: "grow a disk of the machine while it keeps running",
+		flags: func(fs *flag.FlagSet, output io.Writer) func(d *Driver) error {
+			diskName := fs.String("disk", "", "name of the disk, such as disk-0")
+			size := fs.Int("size", 0, "new size of the disk in GiB")
+			return func(d *Driver) error {
+				if *diskName == "" {
+					return errors.New("must specify the disk to expand")
+				}
+				capacity, err := d.ExpandDisk(*diskName, *size)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(output, "%s\n", capacity.String())
+				return nil
+			}
+		},
+	},
+	"migrate": {
+		usage: "live migrate the machine to another host",
+		flags: func(fs *flag.FlagSet, _ io.Writer) func(d *Driver) error {
+			nodeSelector := fs.String("node-selector", "", "labels the target host must have, such as key1=value1,key2=value2")
+			return func(d *Driver) error {
+				selector, err := labels.ConvertSelectorToLabelsMap(*nodeSelector)
+				if err != nil {
+					return fmt.Errorf("invalid node selector %q: %w", *nodeSelector, err)
+				}
+				return d.Migrate(selector)
+			}
+		},
+	},
+	"remove-volume": {
+		usage: "detach a hotplugged disk from the machine, deleting or retaining its volume",
+		flags: func(fs *flag.FlagSet, _ io.Writer) func(d *Driver) error {
+			diskName := fs.String("disk", "", "name of the hotplugged disk, such as disk-2")
+			return func(d *Driver) error {
+				if *diskName == "" {
+					return errors.New("must specify the disk to remove")
+				}
+				return d.RemoveVolume(*diskName)
+			}
+		},
+	},
+	"resize": {
+		usage: "change the CPU count and memory size of the machine, restarting it unless they can be hotplugged",
+		flags: func(fs *flag.FlagSet, _ io.Writer) func(d *Driver) error {
+			cpu := fs.Int("cpu-count", 0, "new CPU count, 0 keeps the current one")
+			memorySize := fs.Int("memory-size", 0, "new memory size in GiB, 0 keeps the current one")
+			return func(d *Driver) error {
+				if *cpu == 0 && *memorySize == 0 {
+					return errors.New("must specify a new cpu count or memory size")
+				}
+				return d.Resize(*cpu, *memorySize)
+			}
+		},
+	},
+	"unpause": {
+		usage: "resume a paused machine",
+		flags: func(*flag.FlagSet, io.Writer) func(d *Driver) error {
+			return (*Driver).Unpause
+		},
+	},
+}
+
+// RunCommand runs the command named by args[0] on the machine named by the
+// last argument, and saves the driver config of the machine afterwards since
+// the operations keep it up to date.
+func RunCommand(args []string, output io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(commandUsage())
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n%s", args[0], commandUsage())
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(output)
+	storagePath := fs.String("storage-path", os.Getenv(storagePathEnvKey), "path of the machine store, required unless "+storagePathEnvKey+" is set")
+	run := cmd.flags(fs, output)
+	fs.Usage = func() {
+		fmt.Fprintf(output, "Usage: %s [options] MACHINE\n\n%s\n\nOptions:\n", args[0], cmd.usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("exactly one machine name is required")
+	}
+	if *storagePath == "" {
+		return fmt.Errorf("must specify the machine store with --storage-path or %s", storagePathEnvKey)
+	}
+
+	configPath := filepath.Join(*storagePath, "machines", fs.Arg(0), "config.json")
+	config, d, err := loadMachine(configPath)
+	if err != nil {
+		return err
+	}
+	err = run(d)
+	if saveErr := saveMachine(configPath, config, d); saveErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to save the config of machine %s: %w", d.MachineName, saveErr))
+	}
+	return err
+}
+
+// loadMachine loads the host config of a machine from the machine store,
+// together with its driver.
+func loadMachine(configPath string) (map[string]json.RawMessage, *Driver, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	var config map[string]json.RawMessage
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, nil, fmt.Errorf("invalid machine config %s: %w", configPath, err)
+	}
+	var name, usedDriver string
+	if err = json.Unmarshal(config["Name"], &name); err != nil {
+		return nil, nil, fmt.Errorf("invalid machine name in %s: %w", configPath, err)
+	}
+	if err = json.Unmarshal(config["DriverName"], &usedDriver); err != nil {
+		return nil, nil, fmt.Errorf("invalid driver name in %s: %w", configPath, err)
+	}
+	if usedDriver != driverName {
+		return nil, nil, fmt.Errorf("machine %s is not created by the %s driver but by %s", name, driverName, usedDriver)
+	}
+	d := NewDriver(name, filepath.Dir(filepath.Dir(filepath.Dir(configPath))))
+	if err = json.Unmarshal(config["Driver"], d); err != nil {
+		return nil, nil, err
+	}
+	return config, d, nil
+}
+
+// saveMachine replaces the driver in the host config of a machine, and
+// writes it like rancher-machine does.
+func saveMachine(configPath string, config map[string]json.RawMessage, d *Driver) error {
+	driverData, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	config["Driver"] = driverData
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(configPath), "config.json.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), configPath)
+}
+
+func commandUsage() string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var usage strings.Builder
+	usage.WriteString("Usage: docker-machine-driver-harvester COMMAND [options] MACHINE\n\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(&usage, "  %-14s %s\n", name, commands[name].usage)
+	}
+	return usage.String()
+}
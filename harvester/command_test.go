@@ -0,0 +1,97 @@
+package harvester
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeMachineConfig(t *testing.T, storagePath, name, usedDriver string) string {
+	d := NewDriver(name, storagePath)
+	d.CPU = 2
+	d.VMNamespace = "default"
+	driverData, err := json.Marshal(d)
+	require.NoError(t, err)
+	data, err := json.Marshal(map[string]interface{}{
+		"ConfigVersion": 3,
+		"Driver":        json.RawMessage(driverData),
+		"DriverName":    usedDriver,
+		"HostOptions":   map[string]interface{}{"Driver": ""},
+		"Name":          name,
+	})
+	require.NoError(t, err)
+	machineDir := filepath.Join(storagePath, "machines", name)
+	require.NoError(t, os.MkdirAll(machineDir, 0700))
+	configPath := filepath.Join(machineDir, "config.json")
+	require.NoError(t, os.WriteFile(configPath, data, 0600))
+	return configPath
+}
+
+func TestRunCommand(t *testing.T) {
+	storagePath := t.TempDir()
+	configPath := writeMachineConfig(t, storagePath, "test-machine", driverName)
+
+	var cpu int
+	commands["test"] = command{
+		flags: func(fs *flag.FlagSet, _ io.Writer) func(d *Driver) error {
+			fs.IntVar(&cpu, "cpu-count", 0, "")
+			return func(d *Driver) error {
+				require.Equal(t, "default", d.VMNamespace)
+				require.Equal(t, storagePath, d.StorePath)
+				d.CPU = cpu
+				return nil
+			}
+		},
+	}
+	defer delete(commands, "test")
+
+	require.NoError(t, RunCommand([]string{"test", "--storage-path", storagePath, "--cpu-count", "4", "test-machine"}, io.Discard))
+
+	config, d, err := loadMachine(configPath)
+	require.NoError(t, err)
+	require.Equal(t, 4, d.CPU)
+	require.Equal(t, "test-machine", d.MachineName)
+	require.JSONEq(t, `{"Driver":""}`, string(config["HostOptions"]))
+}
+
+func TestRunCommandErrors(t *testing.T) {
+	storagePath := t.TempDir()
+	writeMachineConfig(t, storagePath, "other-machine", "amazonec2")
+	writeMachineConfig(t, storagePath, "test-machine", driverName)
+
+	err := RunCommand([]string{"unknown"}, io.Discard)
+	require.ErrorContains(t, err, `unknown command "unknown"`)
+
+	err = RunCommand([]string{"pause", "--storage-path", storagePath}, io.Discard)
+	require.EqualError(t, err, "exactly one machine name is required")
+
+	t.Setenv(storagePathEnvKey, "")
+	err = RunCommand([]string{"pause", "test-machine"}, io.Discard)
+	require.EqualError(t, err, "must specify the machine store with --storage-path or MACHINE_STORAGE_PATH")
+
+	err = RunCommand([]string{"pause", "--storage-path", storagePath, "other-machine"}, io.Discard)
+	require.EqualError(t, err, "machine other-machine is not created by the harvester driver but by amazonec2")
+
+	err = RunCommand([]string{"pause", "--storage-path", storagePath, "missing-machine"}, io.Discard)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	err = RunCommand([]string{"migrate", "--storage-path", storagePath, "--node-selector", "zone", "test-machine"}, io.Discard)
+	require.ErrorContains(t, err, `invalid node selector "zone"`)
+
+	err = RunCommand([]string{"resize", "--storage-path", storagePath, "test-machine"}, io.Discard)
+	require.EqualError(t, err, "must specify a new cpu count or memory size")
+
+	err = RunCommand([]string{"expand-disk", "--storage-path", storagePath, "--size", "20", "test-machine"}, io.Discard)
+	require.EqualError(t, err, "must specify the disk to expand")
+
+	err = RunCommand([]string{"add-volume", "--storage-path", storagePath, "--storage-class-name", "longhorn", "test-machine"}, io.Discard)
+	require.EqualError(t, err, "must specify disk size of the hotplugged disk")
+
+	err = RunCommand([]string{"remove-volume", "--storage-path", storagePath, "test-machine"}, io.Discard)
+	require.EqualError(t, err, "must specify the disk to remove")
+}
@@ -5,7 +5,7 @@ import (
 	"errors"
 	"fmt"
 
-	"github.com/ghodss/yaml"
+	harvsterv1 "github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
 )
 
 func UnmarshalDiskInfo(data []byte) (DiskInfo, error) {
@@ -33,6 +33,10 @@ type Disk struct {
 	Type string `json:"type"`
 
 	HotPlugAble bool `json:"hotPlugAble"`
+
+	// RetainPolicy decides whether the volume is deleted or retained when the
+	// machine is removed, it defaults to the global disk retain policy
+	RetainPolicy string `json:"retainPolicy,omitempty"`
 }
 
 func UnmarshalNetworkInfo(data []byte) (NetworkInfo, error) {
@@ -56,6 +60,10 @@ type NetworkInterface struct {
 
 	Model string `json:"model"`
 	Type  string `json:"type"`
+
+	// Management marks the interface whose address is used to reach the
+	// machine, the first interface is used if none is marked
+	Management bool `json:"management,omitempty"`
 }
 
 type VGPUInfo struct {
@@ -68,6 +76,52 @@ type VGPURequest struct {
 }
 
 func (d *Driver) checkConfig() error {
+	for _, timeout := range []struct {
+		operation string
+		seconds   int
+	}{
+		{operationCreate, d.CreateTimeout},
+		{operationStart, d.StartTimeout},
+		{operationStop, d.StopTimeout},
+		{operationRestart, d.RestartTimeout},
+		{operationRemove, d.RemoveTimeout},
+		{operationMigrate, d.MigrateTimeout},
+		{operationResize, d.ResizeTimeout},
+		{operationExpandDisk, d.ExpandDiskTimeout},
+		{"hotplug", d.HotplugTimeout},
+		{operationBackup, d.RemoveBackupTimeout},
+		{"clean up", d.RemoveCleanupTimeout},
+		{"stop grace period", d.StopGracePeriod},
+		{"remove grace period", d.RemoveGracePeriod},
+		{"guest agent", d.GuestAgentTimeout},
+		{"template version", d.TemplateVersion},
+	} {
+		if timeout.seconds < 0 {
+			return fmt.Errorf("%s timeout cannot be negative, but get: %d", timeout.operation, timeout.seconds)
+		}
+	}
+	if d.StopGracePeriod > 0 && d.StopGracePeriod >= int(operationTimeout(d.StopTimeout).Seconds()) {
+		return fmt.Errorf("stop grace period %ds must be shorter than the stop timeout", d.StopGracePeriod)
+	}
+	if d.RemoveGracePeriod > 0 && d.RemoveGracePeriod >= int(operationTimeout(d.RemoveTimeout).Seconds()) {
+		return fmt.Errorf("remove grace period %ds must be shorter than the remove timeout", d.RemoveGracePeriod)
+	}
+	switch harvsterv1.BackupType(d.RemoveBackupType) {
+	case "", harvsterv1.Backup:
+	case harvsterv1.Snapshot:
+		// Harvester deletes the snapshots of a VM together with the VM
+		return fmt.Errorf("invalid remove backup type %q, snapshots are removed with the machine, use %q", d.RemoveBackupType, harvsterv1.Backup)
+	default:
+		return fmt.Errorf("invalid remove backup type %q, must be %q", d.RemoveBackupType, harvsterv1.Backup)
+	}
+	if err := checkDiskRetainPolicy(d.DiskRetainPolicy); err != nil {
+		return err
+	}
+	switch d.IPFamily {
+	case "", ipFamilyIPv4, ipFamilyIPv6:
+	default:
+		return fmt.Errorf("invalid IP family %q, must be %q or %q", d.IPFamily, ipFamilyIPv4, ipFamilyIPv6)
+	}
 	if d.KeyPairName != "" && d.SSHPrivateKeyPath == "" {
 		return errors.New("must specify the ssh private key path of the harvester key pair")
 	}
@@ -79,8 +133,11 @@ func (d *Driver) checkConfig() error {
 			if disk.Size <= 0 {
 				return errors.New("must specify disk size in harvester disk info")
 			}
+			if err := checkDiskRetainPolicy(disk.RetainPolicy); err != nil {
+				return err
+			}
 		}
-	} else {
+	} else if d.usesImageFlags() {
 		// Compatible with older versions
 		if d.ImageName == "" {
 			return errors.New("must specify harvester image name")
@@ -90,12 +147,19 @@ func (d *Driver) checkConfig() error {
 		}
 	}
 	if d.NetworkInfo != nil {
+		managementInterfaces := 0
 		for _, networkInterface := range d.NetworkInfo.NetworkInterfaces {
 			if networkInterface.NetworkName == "" {
 				return errors.New("must specify network name in harvester network info")
 			}
+			if networkInterface.Management {
+				managementInterfaces++
+			}
 		}
-	} else {
+		if managementInterfaces > 1 {
+			return errors.New("at most one management interface can be specified in harvester network info")
+		}
+	} else if d.TemplateName == "" {
 		// Compatible with older versions
 		if d.NetworkName == "" {
 			return errors.New("must specify harvester network name")
@@ -104,155 +168,13 @@ func (d *Driver) checkConfig() error {
 	return checkNetworkData(d.NetworkData)
 }
 
-func checkNetworkData(networkDataStr string) error {
-	if networkDataStr == "" {
+func checkDiskRetainPolicy(policy string) error {
+	switch policy {
+	case "", diskRetainPolicyDelete, diskRetainPolicyRetain:
 		return nil
+	default:
+		return fmt.Errorf("invalid disk retain policy %q, must be %q or %q", policy, diskRetainPolicyDelete, diskRetainPolicyRetain)
 	}
-
-	network, version, err := parserNetworkData(networkDataStr)
-	if err != nil {
-		return err
-	}
-
-	switch version {
-	case 1:
-		if err = checkNetworkDataV1(network); err != nil {
-			return err
-		}
-	case 2:
-		// TODO check network data v2 version format here
-	}
-
-	return nil
-}
-
-func parserNetworkData(networkDataStr string) (map[string]interface{}, float64, error) {
-	var networkData = make(map[string]interface{})
-	if err := yaml.Unmarshal([]byte(networkDataStr), &networkData); err != nil {
-		return nil, 0, err
-	}
-	// root section
-	var rootSection map[string]interface{}
-	networkSection, ok := networkData["network"]
-	if ok {
-		rootSection = networkSection.(map[string]interface{})
-	} else {
-		rootSection = networkData
-	}
-
-	// network.version
-	versionSection, err := mustGetSection(rootSection, "version")
-	if err != nil {
-		return rootSection, 0, err
-	}
-	version := versionSection.(float64)
-	return rootSection, version, nil
-}
-
-func checkNetworkDataV1(network map[string]interface{}) error {
-	var defaultGatewayCount, nameServerCount, dhcpAllCount int
-
-	// network.config
-	networkConfigSection, err := mustGetSection(network, "config")
-	if err != nil {
-		return err
-	}
-	networkConfigs := networkConfigSection.([]interface{})
-
-	for _, networkConfig := range networkConfigs {
-		config := networkConfig.(map[string]interface{})
-		// network.config[].type
-		typeSection, err := mustGetSection(config, "type")
-		if err != nil {
-			return err
-		}
-		configType := typeSection.(string)
-		switch configType {
-		case "physical":
-			gatewayCount, dhcpCount, err := getGatewayAndDHCPCount(config)
-			if err != nil {
-				return err
-			}
-			defaultGatewayCount += gatewayCount
-			nameServerCount += dhcpCount
-			dhcpAllCount += dhcpCount
-		case "nameserver":
-			nameServerAddressCount, err := getNameServerAddressCount(config)
-			if err != nil {
-				return err
-			}
-			nameServerCount += nameServerAddressCount
-		}
-	}
-
-	if defaultGatewayCount > 1 {
-		return fmt.Errorf("the number of default gateway cannot greater than 1, but get: %d", defaultGatewayCount)
-	}
-
-	if defaultGatewayCount == 0 && dhcpAllCount == 0 {
-		return errors.New("static gateway or dhcp is not configured")
-	}
-
-	if nameServerCount == 0 {
-		return errors.New("nameserver is not configured")
-	}
-
-	return nil
-}
-
-func getNameServerAddressCount(config map[string]interface{}) (int, error) {
-	// network.config[].address
-	nameServerAddressesSection, err := mustGetSection(config, "address")
-	if err != nil {
-		return 0, err
-	}
-	nameServerAddresses := nameServerAddressesSection.([]interface{})
-	return len(nameServerAddresses), nil
-}
-
-func getGatewayAndDHCPCount(config map[string]interface{}) (int, int, error) {
-	var gatewayCount, dhcpCount int
-
-	// network.config[].subnets
-	subnetsSection, err := mustGetSection(config, "subnets")
-	if err != nil {
-		return 0, 0, err
-	}
-	networkSubnets := subnetsSection.([]interface{})
-
-	for _, networkSubnet := range networkSubnets {
-		subnet := networkSubnet.(map[string]interface{})
-		// network.config[].subnets[].type
-		subnetTypeSection, err := mustGetSection(subnet, "type")
-		if err != nil {
-			return 0, 0, err
-		}
-		subnetType := subnetTypeSection.(string)
-		switch subnetType {
-		case "dhcp":
-			// dhcp not always generate a default route
-			// gatewayCount += 1
-			dhcpCount += 1
-		case "static":
-			// network.config[].subnets[].gateway
-			gatewaySection := subnet["gateway"]
-			if gatewaySection != nil {
-				gateway := gatewaySection.(string)
-				if gateway != "" {
-					gatewayCount += 1
-				}
-			}
-		}
-	}
-	return gatewayCount, dhcpCount, nil
-}
-
-func mustGetSection(m map[string]interface{}, k string) (interface{}, error) {
-	section := m[k]
-	if section == nil {
-		return nil, fmt.Errorf("missing section: %s", k)
-	}
-	return section, nil
 }
 
 func parseVGPUInfo(vGPUInfo string) (*VGPUInfo, error) {
@@ -6,16 +6,16 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"time"
 
-	"github.com/rancher/machine/libmachine/drivers"
 	"github.com/rancher/machine/libmachine/log"
 	"github.com/rancher/machine/libmachine/mcnutils"
 	"github.com/rancher/machine/libmachine/ssh"
 	"github.com/rancher/machine/libmachine/state"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/utils/ptr"
 	kubevirtv1 "kubevirt.io/api/core/v1"
 
@@ -32,19 +32,44 @@ const (
 )
 
 func (d *Driver) Create() error {
+	return d.withTimeout(operationCreate, d.CreateTimeout, d.create)
+}
+
+func (d *Driver) create() (err error) {
 	// create keypair
 	if err := d.createKeyPair(); err != nil {
 		return err
 	}
 	// create vm
+	vmBuilder := builder.NewVMBuilder(vmCreator)
+	if d.TemplateName != "" {
+		if vmBuilder, err = d.newTemplateVMBuilder(); err != nil {
+			return err
+		}
+	}
 	cloudInitSource, cloudConfigSecret, err := d.buildCloudInit()
 	if err != nil {
 		return err
 	}
-	vmBuilder := builder.NewVMBuilder("docker-machine-driver-harvester").
-		Namespace(d.VMNamespace).Name(d.MachineName).CPU(d.CPU).Memory(d.MemorySize).
+	specHash, err := d.specHash()
+	if err != nil {
+		return err
+	}
+	vmBuilder = vmBuilder.Namespace(d.VMNamespace).Name(d.MachineName).
 		CloudInitDisk(builder.CloudInitDiskName, builder.DiskBusVirtio, false, 0, *cloudInitSource).
 		EvictionStrategy(true).RunStrategy(kubevirtv1.RunStrategyRerunOnFailure)
+	// CPU and memory are left to the template when not provided
+	if d.CPU > 0 {
+		vmBuilder = vmBuilder.CPU(d.CPU)
+	}
+	if d.MemorySize != "" {
+		vmBuilder = vmBuilder.Memory(d.MemorySize)
+	}
+	vmBuilder.Annotations(map[string]string{
+		machineNameAnnotationKey:       d.MachineName,
+		machineSpecHashAnnotationKey:   specHash,
+		provisioningPhaseAnnotationKey: provisioningPhaseVMCreated,
+	})
 
 	// VM naming convention is of form: clusterName-poolName-generatedString
 	// we can reverse split this to identify unique machinesets name, to label nodes
@@ -103,7 +128,10 @@ func (d *Driver) Create() error {
 			affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution, additionalWeightPodAffinity)
 		}
 	}
-	vmBuilder = vmBuilder.Affinity(affinity)
+	// the template keeps its affinity unless one is provided
+	if affinity != nil || d.TemplateName == "" {
+		vmBuilder = vmBuilder.Affinity(affinity)
+	}
 	// ssh key
 	if d.KeyPairName != "" {
 		vmBuilder = vmBuilder.SSHKey(d.KeyPairName)
@@ -141,18 +169,43 @@ func (d *Driver) Create() error {
 		vm.Spec.Template.Spec.Domain.Firmware = &kubevirtv1.Firmware{Bootloader: &kubevirtv1.Bootloader{EFI: &kubevirtv1.EFI{SecureBoot: &v}}}
 	}
 
-	vm.Spec.Template.Spec.Domain.CPU.DedicatedCPUPlacement = d.CPUPinning
-	vm.Spec.Template.Spec.Domain.CPU.IsolateEmulatorThread = d.IsolateEmulatorThread
+	if d.CPUPinning {
+		vm.Spec.Template.Spec.Domain.CPU.DedicatedCPUPlacement = true
+	}
+	if d.IsolateEmulatorThread {
+		vm.Spec.Template.Spec.Domain.CPU.IsolateEmulatorThread = true
+	}
 
 	if d.CPUModel != "" {
 		vm.Spec.Template.Spec.Domain.CPU.Model = d.CPUModel
 	}
 
-	createdVM, err := d.createVM(vm)
-	if err != nil {
+	// resume the VM if a previous Create was interrupted
+	createdVM, err := d.getVM()
+	switch {
+	case err == nil:
+		if err = d.checkResumableVM(createdVM, specHash); err != nil {
+			return err
+		}
+		log.Infof("Resuming creation of machine %s after phase %s", d.MachineName, createdVM.Annotations[provisioningPhaseAnnotationKey])
+	case apierrors.IsNotFound(err):
+		if createdVM, err = d.createVM(vm); err != nil {
+			return err
+		}
+	default:
 		return err
 	}
-	// create secret
+	defer func() {
+		if err != nil {
+			err = d.rollbackCreate(err, cloudConfigSecret)
+		}
+	}()
+	if d.SSHPrivateKeyPath == "" {
+		if err = d.adoptSSHKeySecret(createdVM); err != nil {
+			return err
+		}
+	}
+	// create secret, or update the one left by an interrupted Create
 	if cloudConfigSecret != nil {
 		cloudConfigSecret.OwnerReferences = []metav1.OwnerReference{
 			{
@@ -162,12 +215,20 @@ func (d *Driver) Create() error {
 				UID:        createdVM.UID,
 			},
 		}
-		if _, err = d.createSecret(cloudConfigSecret); err != nil {
+		if err = d.createOrUpdateSecret(cloudConfigSecret); err != nil {
 			return err
 		}
+		if !provisioningPhaseReached(createdVM, provisioningPhaseSecretCreated) {
+			if err = d.setProvisioningPhase(provisioningPhaseSecretCreated); err != nil {
+				return err
+			}
+		}
 	}
 	// wait vm ready
 	if err = d.waitForReady(); err != nil {
+		return d.diagnoseFailure(err)
+	}
+	if err = d.setProvisioningPhase(provisioningPhaseReady); err != nil {
 		return err
 	}
 	ip, err := d.GetIP()
@@ -179,22 +240,83 @@ func (d *Driver) Create() error {
 	return nil
 }
 
+// createOrUpdateSecret creates the cloud-init secret, or replaces the data of
+// the secret left by an interrupted Create.
+func (d *Driver) createOrUpdateSecret(secret *corev1.Secret) error {
+	_, err := d.createSecret(secret)
+	if !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existing, err := d.getSecret(d.VMNamespace, secret.Name)
+		if err != nil {
+			return err
+		}
+		existing.Data = secret.Data
+		_, err = d.updateSecret(existing)
+		return err
+	})
+}
+
+// rollbackCreate removes the VM, its volumes and the cloud-init secret after
+// Create failed, unless the user asked to keep them for debugging.
+func (d *Driver) rollbackCreate(cause error, cloudConfigSecret *corev1.Secret) error {
+	if d.KeepFailedMachine {
+		log.Warnf("Keeping the resources of failed machine %s in namespace %s", d.MachineName, d.VMNamespace)
+		return cause
+	}
+	log.Warnf("Failed to create machine %s, removing the resources created so far", d.MachineName)
+
+	var rollbackErr error
+	d.withDetachedContext(operationTimeout(d.RemoveTimeout), func() {
+		if cloudConfigSecret != nil {
+			if err := d.deleteSecret(cloudConfigSecret.Name); err != nil && !apierrors.IsNotFound(err) {
+				rollbackErr = err
+				return
+			}
+		}
+		if d.SSHPrivateKeyPath == "" {
+			if err := d.deleteSecret(d.sshKeySecretName()); err != nil && !apierrors.IsNotFound(err) {
+				rollbackErr = err
+				return
+			}
+		}
+		vm, err := d.getVM()
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				rollbackErr = err
+			}
+			return
+		}
+		// the disks were just created, there is nothing to retain
+		rollbackErr = d.removeVM(vm, false)
+	})
+	if rollbackErr != nil {
+		return fmt.Errorf("%w; failed to remove the resources of machine %s: %v", cause, d.MachineName, rollbackErr)
+	}
+	return cause
+}
+
 func (d *Driver) waitForState(desiredState state.State) error {
 	log.Debugf("Waiting for node become %s", desiredState)
-	if err := mcnutils.WaitForSpecific(drivers.MachineInState(d, desiredState), 120, 5*time.Second); err != nil {
-		return fmt.Errorf("too many retries waiting for machine to be %s.  Last error: %s", desiredState, err)
+	inState := func() (bool, error) {
+		currentState, err := d.GetState()
+		return currentState == desiredState, err
+	}
+	if err := d.waitFor(fmt.Sprintf("machine to be %s", desiredState), inState); err != nil {
+		return err
 	}
 	return nil
 }
 
 func (d *Driver) waitForIP() error {
-	ipIsNotEmpty := func() bool {
-		ip, _ := d.GetIP()
-		return ip != ""
+	ipIsNotEmpty := func() (bool, error) {
+		ip, err := d.GetIP()
+		return ip != "", err
 	}
 	log.Debugf("Waiting for node get ip")
-	if err := mcnutils.WaitForSpecific(ipIsNotEmpty, 120, 5*time.Second); err != nil {
-		return fmt.Errorf("too many retries waiting for get machine's ip.  Last error: %s", err)
+	if err := d.waitFor("machine's ip", ipIsNotEmpty); err != nil {
+		return err
 	}
 	return nil
 }
@@ -207,16 +329,16 @@ func (d *Driver) waitForReady() error {
 }
 
 func (d *Driver) waitForRestart(oldUID string) error {
-	restarted := func() bool {
+	restarted := func() (bool, error) {
 		vmi, err := d.getVMI()
 		if err != nil {
-			return false
+			return false, err
 		}
-		return oldUID != string(vmi.UID)
+		return oldUID != string(vmi.UID), nil
 	}
 	log.Debugf("Waiting for node restarted")
-	if err := mcnutils.WaitForSpecific(restarted, 120, 5*time.Second); err != nil {
-		return fmt.Errorf("too many retries waiting for machine restart.  Last error: %s", err)
+	if err := d.waitFor("machine restart", restarted); err != nil {
+		return err
 	}
 	return d.waitForReady()
 }
@@ -225,10 +347,20 @@ func (d *Driver) createKeyPair() error {
 	keyPath := d.GetSSHKeyPath()
 	publicKeyFile := keyPath + ".pub"
 	if d.SSHPrivateKeyPath == "" {
-		log.Debugf("Creating New SSH Key")
-		if err := ssh.GenerateSSHKey(keyPath); err != nil {
+		// a retried Create keeps the key generated by the interrupted one
+		restored, err := d.restoreSSHKey(keyPath)
+		if err != nil {
 			return err
 		}
+		if !restored {
+			log.Debugf("Creating New SSH Key")
+			if err = ssh.GenerateSSHKey(keyPath); err != nil {
+				return err
+			}
+			if err = d.saveSSHKey(keyPath); err != nil {
+				return err
+			}
+		}
 	} else {
 		log.Debugf("Using SSHPrivateKeyPath: %s", d.SSHPrivateKeyPath)
 		if err := mcnutils.CopyFile(d.SSHPrivateKeyPath, keyPath); err != nil {
@@ -285,6 +417,22 @@ func (d *Driver) addDisk(vmBuilder *builder.VMBuilder, disk *Disk, diskIndex int
 
 func (d *Driver) Disks(vmBuilder *builder.VMBuilder) (*builder.VMBuilder, error) {
 	var err error
+	if d.RestoreFrom != "" {
+		backup, err := d.getRestoreBackup()
+		if err != nil {
+			return nil, err
+		}
+		disks, err := restoredDisks(backup, d.VMNamespace, d.RestoreDataDisks)
+		if err != nil {
+			return nil, err
+		}
+		for i, disk := range disks {
+			vmBuilder, err = d.addRestoredDisk(vmBuilder, disk, i)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
 	if d.DiskInfo != nil {
 		for i, disk := range d.DiskInfo.Disks {
 			vmBuilder, err = d.addDisk(vmBuilder, &disk, i)
@@ -292,7 +440,7 @@ func (d *Driver) Disks(vmBuilder *builder.VMBuilder) (*builder.VMBuilder, error)
 				return nil, err
 			}
 		}
-	} else {
+	} else if d.usesImageFlags() {
 		// Compatible with older versions
 		diskSize, err := strconv.Atoi(d.DiskSize)
 		if err != nil {
@@ -330,7 +478,7 @@ func (d *Driver) NetworkInterfaces(vmBuilder *builder.VMBuilder) *builder.VMBuil
 		for i, networkInterface := range d.NetworkInfo.NetworkInterfaces {
 			d.AddNetworkInterface(vmBuilder, &networkInterface, i)
 		}
-	} else {
+	} else if d.TemplateName == "" || d.NetworkName != "" {
 		// Compatible with older versions
 		networkInterface := NetworkInterface{
 			NetworkName: d.NetworkName,
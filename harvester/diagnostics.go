@@ -0,0 +1,310 @@
+package harvester
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/machine/libmachine/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	harvesterutil "github.com/harvester/harvester/pkg/util"
+)
+
+const (
+	diagnosticsFileName    = "diagnostics.json"
+	diagnosticsTimeout     = 30 * time.Second
+	diagnosticsEventsLimit = 20
+
+	cdiImportPhaseAnnotationKey = "cdi.kubevirt.io/storage.pod.phase"
+)
+
+// Diagnostics describes why a machine did not become ready, so that failed
+// provisioning can be debugged without access to the Harvester cluster.
+type Diagnostics struct {
+	VMStatus      string   `json:"vmStatus,omitempty"`
+	VMConditions  []string `json:"vmConditions,omitempty"`
+	VMIPhase      string   `json:"vmiPhase,omitempty"`
+	VMIConditions []string `json:"vmiConditions,omitempty"`
+	LauncherPods  []string `json:"launcherPods,omitempty"`
+	Volumes       []string `json:"volumes,omitempty"`
+	Images        []string `json:"images,omitempty"`
+	Events        []string `json:"events,omitempty"`
+	// Errors lists the diagnostics which could not be collected
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (diag *Diagnostics) String() string {
+	var b strings.Builder
+	section := func(title string, lines ...string) {
+		if len(lines) == 0 || (len(lines) == 1 && lines[0] == "") {
+			return
+		}
+		fmt.Fprintf(&b, "\n%s:", title)
+		for _, line := range lines {
+			fmt.Fprintf(&b, "\n  %s", line)
+		}
+	}
+	section("vm status", diag.VMStatus)
+	section("vm conditions", diag.VMConditions...)
+	section("vmi phase", diag.VMIPhase)
+	section("vmi conditions", diag.VMIConditions...)
+	section("virt-launcher pods", diag.LauncherPods...)
+	section("volumes", diag.Volumes...)
+	section("images", diag.Images...)
+	section("events", diag.Events...)
+	section("diagnostics errors", diag.Errors...)
+	return b.String()
+}
+
+// DiagnosticsError is returned when a machine fails to become ready, and
+// carries the diagnostics collected at the time of the failure.
+type DiagnosticsError struct {
+	Err         error
+	Diagnostics *Diagnostics
+}
+
+func (e *DiagnosticsError) Error() string {
+	return fmt.Sprintf("%s%s", e.Err, e.Diagnostics)
+}
+
+func (e *DiagnosticsError) Unwrap() error {
+	return e.Err
+}
+
+// diagnoseFailure wraps err with the diagnostics of the machine, and writes
+// them to the machine store if enabled.
+func (d *Driver) diagnoseFailure(err error) error {
+	var diag *Diagnostics
+	d.withDetachedContext(diagnosticsTimeout, func() {
+		diag = d.collectDiagnostics()
+	})
+
+	if d.SaveDiagnostics {
+		if writeErr := d.writeDiagnostics(diag); writeErr != nil {
+			log.Warnf("Failed to save diagnostics of machine %s: %v", d.MachineName, writeErr)
+		}
+	}
+	return &DiagnosticsError{Err: err, Diagnostics: diag}
+}
+
+func (d *Driver) writeDiagnostics(diag *Diagnostics) error {
+	data, err := json.MarshalIndent(diag, "", "  ")
+	if err != nil {
+		return err
+	}
+	diagnosticsPath := d.ResolveStorePath(diagnosticsFileName)
+	if err = os.WriteFile(diagnosticsPath, data, 0600); err != nil {
+		return err
+	}
+	log.Infof("Diagnostics of machine %s saved to %s", d.MachineName, diagnosticsPath)
+	return nil
+}
+
+func (d *Driver) collectDiagnostics() *Diagnostics {
+	diag := &Diagnostics{}
+	addError := func(what string, err error) {
+		diag.Errors = append(diag.Errors, fmt.Sprintf("%s: %v", what, err))
+	}
+
+	// objects which may have events about the machine
+	involvedObjects := []string{d.MachineName}
+
+	vm, err := d.getVM()
+	if err != nil {
+		addError("get vm", err)
+	} else {
+		diag.VMStatus = string(vm.Status.PrintableStatus)
+		for _, condition := range vm.Status.Conditions {
+			diag.VMConditions = append(diag.VMConditions, formatConditionLine(string(condition.Type), condition.Status, condition.Reason, condition.Message))
+		}
+		volumes, images, claimNames := d.collectVolumeDiagnostics(vm, addError)
+		diag.Volumes = volumes
+		diag.Images = images
+		involvedObjects = append(involvedObjects, claimNames...)
+	}
+
+	vmi, err := d.getVMI()
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			addError("get vmi", err)
+		}
+	} else {
+		diag.VMIPhase = string(vmi.Status.Phase)
+		for _, condition := range vmi.Status.Conditions {
+			diag.VMIConditions = append(diag.VMIConditions, formatConditionLine(string(condition.Type), condition.Status, condition.Reason, condition.Message))
+		}
+		pods, err := d.listLauncherPods(vmi)
+		if err != nil {
+			addError("list virt-launcher pods", err)
+		}
+		for _, pod := range pods {
+			diag.LauncherPods = append(diag.LauncherPods, formatPodStatus(&pod))
+			involvedObjects = append(involvedObjects, pod.Name)
+		}
+	}
+
+	events, err := d.listEvents(involvedObjects)
+	if err != nil {
+		addError("list events", err)
+	}
+	diag.Events = formatEvents(events, diagnosticsEventsLimit)
+	return diag
+}
+
+func (d *Driver) collectVolumeDiagnostics(vm *kubevirtv1.VirtualMachine, addError func(string, error)) (volumes []string, images []string, claimNames []string) {
+	c, err := d.getClient()
+	if err != nil {
+		addError("get client", err)
+		return
+	}
+	seenImages := map[string]struct{}{}
+	for _, volume := range vm.Spec.Template.Spec.Volumes {
+		// CDI names the claim of a data volume after the data volume
+		var claimName string
+		switch {
+		case volume.PersistentVolumeClaim != nil:
+			claimName = volume.PersistentVolumeClaim.ClaimName
+		case volume.DataVolume != nil:
+			claimName = volume.DataVolume.Name
+		default:
+			continue
+		}
+		claimNames = append(claimNames, claimName)
+		pvc, err := c.KubeClient.CoreV1().PersistentVolumeClaims(d.VMNamespace).Get(d.ctx, claimName, metav1.GetOptions{})
+		if err != nil {
+			addError(fmt.Sprintf("get pvc %s", claimName), err)
+			continue
+		}
+		line := fmt.Sprintf("pvc %s: %s", pvc.Name, pvc.Status.Phase)
+		if importPhase := pvc.Annotations[cdiImportPhaseAnnotationKey]; importPhase != "" {
+			line += fmt.Sprintf(", import %s", importPhase)
+		}
+		volumes = append(volumes, line)
+
+		imageID := pvc.Annotations[harvesterutil.AnnotationImageID]
+		if _, ok := seenImages[imageID]; imageID == "" || ok {
+			continue
+		}
+		seenImages[imageID] = struct{}{}
+		image, err := d.getImage(imageID)
+		if err != nil {
+			addError(fmt.Sprintf("get image %s", imageID), err)
+			continue
+		}
+		line = fmt.Sprintf("image %s: progress %d%%", imageID, image.Status.Progress)
+		for _, condition := range image.Status.Conditions {
+			line += "; " + formatConditionLine(string(condition.Type), condition.Status, condition.Reason, condition.Message)
+		}
+		images = append(images, line)
+	}
+	return
+}
+
+func (d *Driver) listLauncherPods(vmi *kubevirtv1.VirtualMachineInstance) ([]corev1.Pod, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	podList, err := c.KubeClient.CoreV1().Pods(d.VMNamespace).List(d.ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{kubevirtv1.CreatedByLabel: string(vmi.UID)}.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return podList.Items, nil
+}
+
+func (d *Driver) listEvents(involvedObjectNames []string) ([]corev1.Event, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		events []corev1.Event
+		errs   []error
+	)
+	for _, name := range involvedObjectNames {
+		eventList, err := c.KubeClient.CoreV1().Events(d.VMNamespace).List(d.ctx, metav1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("involvedObject.name", name).String(),
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		events = append(events, eventList.Items...)
+	}
+	return events, errors.Join(errs...)
+}
+
+func formatConditionLine(conditionType string, status corev1.ConditionStatus, reason, message string) string {
+	line := fmt.Sprintf("%s=%s", conditionType, status)
+	if reason != "" {
+		line += " " + reason
+	}
+	if message != "" {
+		line += ": " + message
+	}
+	return line
+}
+
+func formatPodStatus(pod *corev1.Pod) string {
+	line := fmt.Sprintf("%s: %s", pod.Name, pod.Status.Phase)
+	if pod.Spec.NodeName != "" {
+		line += fmt.Sprintf(" on %s", pod.Spec.NodeName)
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue && condition.Message != "" {
+			line += "; " + formatConditionLine(string(condition.Type), condition.Status, condition.Reason, condition.Message)
+		}
+	}
+	for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		if waiting := status.State.Waiting; waiting != nil && waiting.Reason != "" {
+			line += fmt.Sprintf("; container %s waiting: %s", status.Name, waiting.Reason)
+			if waiting.Message != "" {
+				line += ": " + waiting.Message
+			}
+		}
+		if terminated := status.State.Terminated; terminated != nil && terminated.ExitCode != 0 {
+			line += fmt.Sprintf("; container %s terminated: %s (exit code %d)", status.Name, terminated.Reason, terminated.ExitCode)
+		}
+	}
+	return line
+}
+
+// formatEvents returns the most recent events, oldest first.
+func formatEvents(events []corev1.Event, limit int) []string {
+	eventTime := func(event *corev1.Event) time.Time {
+		switch {
+		case !event.LastTimestamp.IsZero():
+			return event.LastTimestamp.Time
+		case !event.EventTime.IsZero():
+			return event.EventTime.Time
+		default:
+			return event.CreationTimestamp.Time
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventTime(&events[i]).Before(eventTime(&events[j]))
+	})
+	if len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+
+	lines := make([]string, 0, len(events))
+	for i := range events {
+		event := &events[i]
+		lines = append(lines, fmt.Sprintf("%s %s %s/%s %s: %s",
+			eventTime(event).UTC().Format(time.RFC3339), event.Type, event.InvolvedObject.Kind, event.InvolvedObject.Name, event.Reason, event.Message))
+	}
+	return lines
+}
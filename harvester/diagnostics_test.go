@@ -0,0 +1,69 @@
+package harvester
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDiagnosticsError(t *testing.T) {
+	cause := errors.New("timed out waiting for machine to be Running")
+	err := &DiagnosticsError{
+		Err: cause,
+		Diagnostics: &Diagnostics{
+			VMStatus:     "ErrorUnschedulable",
+			VMConditions: []string{"Ready=False PodNotExists"},
+		},
+	}
+	require.ErrorIs(t, err, cause)
+	require.EqualError(t, err, `timed out waiting for machine to be Running
+vm status:
+  ErrorUnschedulable
+vm conditions:
+  Ready=False PodNotExists`)
+}
+
+func TestFormatPodStatus(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "virt-launcher-test-machine-abcde"},
+		Spec:       corev1.PodSpec{NodeName: "harvester-1"},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodPending,
+			ContainerStatuses: []corev1.ContainerStatus{
+				{
+					Name: "compute",
+					State: corev1.ContainerState{
+						Waiting: &corev1.ContainerStateWaiting{Reason: "ErrImagePull", Message: "image not found"},
+					},
+				},
+			},
+		},
+	}
+	require.Equal(t, "virt-launcher-test-machine-abcde: Pending on harvester-1; container compute waiting: ErrImagePull: image not found", formatPodStatus(pod))
+}
+
+func TestFormatEvents(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newEvent := func(reason string, offset time.Duration) corev1.Event {
+		return corev1.Event{
+			InvolvedObject: corev1.ObjectReference{Kind: "VirtualMachine", Name: "test-machine"},
+			Type:           corev1.EventTypeWarning,
+			Reason:         reason,
+			Message:        "message",
+			LastTimestamp:  metav1.NewTime(now.Add(offset)),
+		}
+	}
+	events := []corev1.Event{
+		newEvent("Third", 2*time.Minute),
+		newEvent("First", 0),
+		newEvent("Second", time.Minute),
+	}
+	require.Equal(t, []string{
+		"2024-01-01T00:01:00Z Warning VirtualMachine/test-machine Second: message",
+		"2024-01-01T00:02:00Z Warning VirtualMachine/test-machine Third: message",
+	}, formatEvents(events, 2))
+}
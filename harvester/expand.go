@@ -0,0 +1,169 @@
+package harvester
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/rancher/machine/libmachine/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/utils/ptr"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// ExpandDisk grows the volume of the machine disk with the given name, such
+// as disk-0, to size GiB and returns its new capacity. The machine keeps
+// running while the volume is expanded. It is run by the expand-disk command.
+func (d *Driver) ExpandDisk(diskName string, size int) (resource.Quantity, error) {
+	var capacity resource.Quantity
+	err := d.withTimeout(operationExpandDisk, d.ExpandDiskTimeout, func() error {
+		var err error
+		capacity, err = d.expandDisk(diskName, size)
+		return err
+	})
+	return capacity, err
+}
+
+func (d *Driver) expandDisk(diskName string, size int) (resource.Quantity, error) {
+	log.Debugf("Expand node disk %s", diskName)
+	if size <= 0 {
+		return resource.Quantity{}, fmt.Errorf("invalid disk size %dGi", size)
+	}
+	requested := *resource.NewQuantity(int64(size)<<30, resource.BinarySI)
+
+	vm, err := d.getVM()
+	if err != nil {
+		return resource.Quantity{}, err
+	}
+	claimName, err := diskClaimName(vm, diskName)
+	if err != nil {
+		return resource.Quantity{}, err
+	}
+	pvc, err := d.getPVC(claimName)
+	if err != nil {
+		return resource.Quantity{}, err
+	}
+	current := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	switch requested.Cmp(current) {
+	case -1:
+		return resource.Quantity{}, fmt.Errorf("disk %s of machine %s cannot shrink from %s to %s", diskName, d.MachineName, current.String(), requested.String())
+	case 1:
+		if err = d.checkExpandable(pvc); err != nil {
+			return resource.Quantity{}, err
+		}
+		log.Infof("Expanding disk %s of machine %s from %s to %s", diskName, d.MachineName, current.String(), requested.String())
+		if _, err = d.patchPVCSize(claimName, requested); err != nil {
+			return resource.Quantity{}, err
+		}
+	}
+
+	capacity, err := d.waitForExpansion(claimName, requested)
+	if err != nil {
+		return resource.Quantity{}, err
+	}
+	d.setDiskSize(diskName, size)
+	log.Infof("Disk %s of machine %s has a capacity of %s", diskName, d.MachineName, capacity.String())
+	return capacity, nil
+}
+
+// diskClaimName returns the claim of the VM disk with the given name.
+func diskClaimName(vm *kubevirtv1.VirtualMachine, diskName string) (string, error) {
+	for _, volume := range vm.Spec.Template.Spec.Volumes {
+		if volume.Name != diskName {
+			continue
+		}
+		if volume.PersistentVolumeClaim == nil {
+			return "", fmt.Errorf("disk %s of machine %s is not backed by a volume", diskName, vm.Name)
+		}
+		return volume.PersistentVolumeClaim.ClaimName, nil
+	}
+	return "", fmt.Errorf("disk %s not found in machine %s", diskName, vm.Name)
+}
+
+// checkExpandable checks that the storage class of pvc allows expansion, and
+// that a previous expansion did not fail.
+func (d *Driver) checkExpandable(pvc *corev1.PersistentVolumeClaim) error {
+	storageClassName := ptr.Deref(pvc.Spec.StorageClassName, "")
+	if storageClassName == "" {
+		return fmt.Errorf("volume %s has no storage class, it cannot be expanded", pvc.Name)
+	}
+	storageClass, err := d.getStorageClass(storageClassName)
+	if err != nil {
+		return err
+	}
+	if !ptr.Deref(storageClass.AllowVolumeExpansion, false) {
+		return fmt.Errorf("storage class %s of volume %s does not allow volume expansion", storageClassName, pvc.Name)
+	}
+	return expansionError(pvc)
+}
+
+// expansionError returns the reason why the expansion of pvc failed, if it
+// did.
+func expansionError(pvc *corev1.PersistentVolumeClaim) error {
+	switch pvc.Status.AllocatedResourceStatuses[corev1.ResourceStorage] {
+	case corev1.PersistentVolumeClaimControllerResizeInfeasible, corev1.PersistentVolumeClaimNodeResizeInfeasible:
+		return fmt.Errorf("expansion of volume %s is infeasible", pvc.Name)
+	}
+	for _, condition := range pvc.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case corev1.PersistentVolumeClaimControllerResizeError, corev1.PersistentVolumeClaimNodeResizeError:
+			return fmt.Errorf("expansion of volume %s failed: %s", pvc.Name, condition.Message)
+		}
+	}
+	return nil
+}
+
+// waitForExpansion waits for the capacity of the claim to reach size, and
+// returns it.
+func (d *Driver) waitForExpansion(claimName string, size resource.Quantity) (resource.Quantity, error) {
+	c, err := d.getClient()
+	if err != nil {
+		return resource.Quantity{}, err
+	}
+	var (
+		capacity     resource.Quantity
+		expansionErr error
+	)
+	expanded := func() (bool, error) {
+		pvc, err := d.getPVC(claimName)
+		if err != nil {
+			return false, err
+		}
+		capacity = pvc.Status.Capacity[corev1.ResourceStorage]
+		if capacity.Cmp(size) >= 0 {
+			return true, nil
+		}
+		if expansionErr = expansionError(pvc); expansionErr != nil {
+			return true, nil
+		}
+		return false, nil
+	}
+	log.Debugf("Waiting for node disk expanded")
+	if err = d.waitForTargets(fmt.Sprintf("volume %s expanded to %s", claimName, size.String()), expanded, []watchTarget{
+		{kind: "pvc", name: claimName, watchFn: c.KubeClient.CoreV1().PersistentVolumeClaims(d.VMNamespace).Watch},
+	}); err != nil {
+		return resource.Quantity{}, err
+	}
+	return capacity, expansionErr
+}
+
+// setDiskSize records the new size of a disk built from the driver config.
+func (d *Driver) setDiskSize(diskName string, size int) {
+	index, ok := diskIndex(diskName)
+	if !ok {
+		return
+	}
+	if d.DiskInfo != nil {
+		if index < len(d.DiskInfo.Disks) {
+			d.DiskInfo.Disks[index].Size = size
+		}
+		return
+	}
+	// disks of older versions are always disk-1
+	if index == 1 && d.usesImageFlags() {
+		d.DiskSize = strconv.Itoa(size)
+	}
+}
@@ -0,0 +1,81 @@
+package harvester
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func TestDiskClaimName(t *testing.T) {
+	vm := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-machine"},
+		Spec: kubevirtv1.VirtualMachineSpec{
+			Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
+				Spec: kubevirtv1.VirtualMachineInstanceSpec{
+					Volumes: []kubevirtv1.Volume{
+						{
+							Name: "disk-0",
+							VolumeSource: kubevirtv1.VolumeSource{
+								PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
+									PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{ClaimName: "test-machine-disk-0-abcde"},
+								},
+							},
+						},
+						{
+							Name:         "cloudinitdisk",
+							VolumeSource: kubevirtv1.VolumeSource{CloudInitNoCloud: &kubevirtv1.CloudInitNoCloudSource{}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	claimName, err := diskClaimName(vm, "disk-0")
+	require.NoError(t, err)
+	require.Equal(t, "test-machine-disk-0-abcde", claimName)
+
+	_, err = diskClaimName(vm, "cloudinitdisk")
+	require.EqualError(t, err, "disk cloudinitdisk of machine test-machine is not backed by a volume")
+
+	_, err = diskClaimName(vm, "disk-1")
+	require.EqualError(t, err, "disk disk-1 not found in machine test-machine")
+}
+
+func TestExpansionError(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "test-pvc"}}
+	require.NoError(t, expansionError(pvc))
+
+	pvc.Status.Conditions = []corev1.PersistentVolumeClaimCondition{
+		{Type: corev1.PersistentVolumeClaimResizing, Status: corev1.ConditionTrue},
+	}
+	require.NoError(t, expansionError(pvc))
+
+	pvc.Status.Conditions = append(pvc.Status.Conditions, corev1.PersistentVolumeClaimCondition{
+		Type:    corev1.PersistentVolumeClaimControllerResizeError,
+		Status:  corev1.ConditionTrue,
+		Message: "not enough space",
+	})
+	require.EqualError(t, expansionError(pvc), "expansion of volume test-pvc failed: not enough space")
+
+	pvc.Status.AllocatedResourceStatuses = map[corev1.ResourceName]corev1.ClaimResourceStatus{
+		corev1.ResourceStorage: corev1.PersistentVolumeClaimNodeResizeInfeasible,
+	}
+	require.EqualError(t, expansionError(pvc), "expansion of volume test-pvc is infeasible")
+}
+
+func TestSetDiskSize(t *testing.T) {
+	d := NewDriver("test-machine", "")
+	d.ImageName = "default/image"
+	d.DiskSize = "40"
+	d.setDiskSize("disk-1", 80)
+	require.Equal(t, "80", d.DiskSize)
+
+	d.DiskInfo = &DiskInfo{Disks: []Disk{{Size: 40}, {Size: 10}}}
+	d.setDiskSize("disk-1", 20)
+	d.setDiskSize("restored-disk-0", 100)
+	require.Equal(t, []Disk{{Size: 40}, {Size: 20}}, d.DiskInfo.Disks)
+}
@@ -20,6 +20,10 @@ const (
 	defaultReservedMemorySize = -1 // -1 means no input
 	defaultDiskBus            = "virtio"
 	defaultNetworkModel       = "virtio"
+	defaultDiskRetainPolicy   = diskRetainPolicyDelete
+	defaultIPFamily           = ipFamilyIPv4
+
+	defaultOperationTimeout = 600 // in seconds
 )
 
 func (d *Driver) GetCreateFlags() []mcnflag.Flag {
@@ -53,14 +57,12 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		mcnflag.IntFlag{
 			EnvVar: "HARVESTER_CPU_COUNT",
 			Name:   "harvester-cpu-count",
-			Usage:  "number of CPUs for machine",
-			Value:  defaultCPU,
+			Usage:  fmt.Sprintf("number of CPUs for machine, 0 means the CPUs of the template, or %d without a template", defaultCPU),
 		},
 		mcnflag.IntFlag{
 			EnvVar: "HARVESTER_MEMORY_SIZE",
 			Name:   "harvester-memory-size",
-			Usage:  "size of memory for machine (in GiB)",
-			Value:  defaultMemorySize,
+			Usage:  fmt.Sprintf("size of memory for machine (in GiB), 0 means the memory of the template, or %d without a template", defaultMemorySize),
 		},
 		mcnflag.IntFlag{
 			EnvVar: "HARVESTER_DISK_SIZE",
@@ -82,6 +84,32 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Name:   "harvester-disk-info",
 			Usage:  "harvester disk info",
 		},
+		mcnflag.StringFlag{
+			EnvVar: "HARVESTER_DISK_RETAIN_POLICY",
+			Name:   "harvester-disk-retain-policy",
+			Usage:  "whether disks are deleted or retained when the machine is removed (delete or retain), can be overridden per disk in harvester disk info",
+			Value:  defaultDiskRetainPolicy,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "HARVESTER_RESTORE_FROM",
+			Name:   "harvester-restore-from",
+			Usage:  "name of a harvester VM backup or snapshot in the machine namespace to restore the boot disk from instead of using an image",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "HARVESTER_RESTORE_DATA_DISKS",
+			Name:   "harvester-restore-data-disks",
+			Usage:  "also restore the data disks of the harvester VM backup or snapshot",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "HARVESTER_TEMPLATE_NAME",
+			Name:   "harvester-template-name",
+			Usage:  "harvester VM template to create the machine from, only the cpu count and memory size different from their defaults, and the disk, network and cloud-init flags which are set override the template",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_TEMPLATE_VERSION",
+			Name:   "harvester-template-version",
+			Usage:  "version of the harvester VM template, the default version of the template if not set",
+		},
 		mcnflag.StringFlag{
 			EnvVar: "HARVESTER_SSH_USER",
 			Name:   "harvester-ssh-user",
@@ -129,6 +157,12 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Name:   "harvester-network-info",
 			Usage:  "harvester network info",
 		},
+		mcnflag.StringFlag{
+			EnvVar: "HARVESTER_IP_FAMILY",
+			Name:   "harvester-ip-family",
+			Usage:  "preferred IP family of the machine address (ipv4 or ipv6), an address of the other family is used if the machine has none of the preferred one",
+			Value:  defaultIPFamily,
+		},
 		mcnflag.StringFlag{
 			EnvVar: "HARVESTER_CLOUD_CONFIG",
 			Name:   "harvester-cloud-config",
@@ -190,6 +224,108 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Name:   "harvester-cpu-model",
 			Usage:  "model of CPU for machine",
 		},
+		mcnflag.BoolFlag{
+			EnvVar: "HARVESTER_SAVE_DIAGNOSTICS",
+			Name:   "harvester-save-diagnostics",
+			Usage:  "save diagnostics to the machine store path when the machine fails to become ready",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "HARVESTER_KEEP_FAILED_MACHINE",
+			Name:   "harvester-keep-failed-machine",
+			Usage:  "keep the vm, volumes and secrets of a machine which failed to be created, for debugging",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_CREATE_TIMEOUT",
+			Name:   "harvester-create-timeout",
+			Usage:  "timeout for creating the machine and waiting for it to be running (in seconds)",
+			Value:  defaultOperationTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_START_TIMEOUT",
+			Name:   "harvester-start-timeout",
+			Usage:  "timeout for starting the machine (in seconds)",
+			Value:  defaultOperationTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_STOP_TIMEOUT",
+			Name:   "harvester-stop-timeout",
+			Usage:  "timeout for stopping the machine (in seconds)",
+			Value:  defaultOperationTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_STOP_GRACE_PERIOD",
+			Name:   "harvester-stop-grace-period",
+			Usage:  "time to wait for the machine to shut down gracefully before killing it on stop (in seconds), 0 means never kill it",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_GUEST_AGENT_TIMEOUT",
+			Name:   "harvester-guest-agent-timeout",
+			Usage:  "time given to a booted machine to shut down on an ACPI shutdown on stop, or to soft reboot on restart, before powering it off or restarting it (in seconds), 0 disables both",
+			Value:  defaultGuestAgentTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_RESTART_TIMEOUT",
+			Name:   "harvester-restart-timeout",
+			Usage:  "timeout for restarting the machine (in seconds)",
+			Value:  defaultOperationTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_REMOVE_TIMEOUT",
+			Name:   "harvester-remove-timeout",
+			Usage:  "timeout for removing the machine (in seconds)",
+			Value:  defaultOperationTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_REMOVE_GRACE_PERIOD",
+			Name:   "harvester-remove-grace-period",
+			Usage:  "time to wait for the machine to be removed before force deleting its vmi and virt-launcher pod (in seconds), 0 means never force it",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "HARVESTER_FORCE_REMOVE_FINALIZERS",
+			Name:   "harvester-force-remove-finalizers",
+			Usage:  "also remove kubevirt and harvester finalizers from the vm and vmi when forcing the removal of the machine",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "HARVESTER_REMOVE_BACKUP_TYPE",
+			Name:   "harvester-remove-backup-type",
+			Usage:  "create a harvester vm backup of this type and wait for it to be ready before removing the machine, only backup is supported since snapshots are removed with the machine, empty means no backup",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_REMOVE_BACKUP_TIMEOUT",
+			Name:   "harvester-remove-backup-timeout",
+			Usage:  "timeout for the backup created before removing the machine (in seconds)",
+			Value:  defaultRemoveBackupTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_REMOVE_CLEANUP_TIMEOUT",
+			Name:   "harvester-remove-cleanup-timeout",
+			Usage:  "time to wait for the volumes and secrets of the machine to be deleted after removing it, before reporting them as left behind (in seconds)",
+			Value:  defaultRemoveCleanupTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_MIGRATE_TIMEOUT",
+			Name:   "harvester-migrate-timeout",
+			Usage:  "timeout for live migrating the machine to another host (in seconds)",
+			Value:  defaultOperationTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_RESIZE_TIMEOUT",
+			Name:   "harvester-resize-timeout",
+			Usage:  "timeout for changing the CPU count and memory size of the machine (in seconds)",
+			Value:  defaultOperationTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_EXPAND_DISK_TIMEOUT",
+			Name:   "harvester-expand-disk-timeout",
+			Usage:  "timeout for expanding a disk of the machine (in seconds)",
+			Value:  defaultOperationTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HARVESTER_HOTPLUG_TIMEOUT",
+			Name:   "harvester-hotplug-timeout",
+			Usage:  "timeout for adding a volume to or removing a volume from the running machine (in seconds)",
+			Value:  defaultOperationTimeout,
+		},
 	}
 }
 
@@ -217,6 +353,25 @@ func (d *Driver) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// setSize sets the CPU count and the memory size (in GiB) of the machine.
+// Zero means not provided: the value is then left to the template, or takes
+// the default when no template is used.
+func (d *Driver) setSize(cpu, memorySize int) {
+	if d.TemplateName == "" {
+		if cpu == 0 {
+			cpu = defaultCPU
+		}
+		if memorySize == 0 {
+			memorySize = defaultMemorySize
+		}
+	}
+	d.CPU = cpu
+	d.MemorySize = ""
+	if memorySize != 0 {
+		d.MemorySize = fmt.Sprintf("%dGi", memorySize)
+	}
+}
+
 func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.KubeConfigContent = stringSupportBase64(flags.String("harvester-kubeconfig-content"))
 
@@ -226,9 +381,11 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.ClusterID = flags.String("harvester-cluster-id")
 	d.ClusterName = flags.String("harvester-cluster-name")
 
-	d.CPU = flags.Int("harvester-cpu-count")
+	d.TemplateName = flags.String("harvester-template-name")
+	d.TemplateVersion = flags.Int("harvester-template-version")
+
+	d.setSize(flags.Int("harvester-cpu-count"), flags.Int("harvester-memory-size"))
 	d.CPUModel = flags.String("harvester-cpu-model")
-	d.MemorySize = fmt.Sprintf("%dGi", flags.Int("harvester-memory-size"))
 	if flags.Int("harvester-reserved-memory-size") > 0 {
 		d.ReservedMemorySize = fmt.Sprintf("%dMi", flags.Int("harvester-reserved-memory-size"))
 	}
@@ -246,6 +403,9 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 		}
 		d.DiskInfo = &diskInfo
 	}
+	d.DiskRetainPolicy = flags.String("harvester-disk-retain-policy")
+	d.RestoreFrom = flags.String("harvester-restore-from")
+	d.RestoreDataDisks = flags.Bool("harvester-restore-data-disks")
 
 	d.SSHUser = flags.String("harvester-ssh-user")
 	d.SSHPort = flags.Int("harvester-ssh-port")
@@ -267,6 +427,7 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 		}
 		d.NetworkInfo = &networkInfo
 	}
+	d.IPFamily = flags.String("harvester-ip-family")
 
 	d.CloudConfig = flags.String("harvester-cloud-config")
 	d.UserData = stringSupportBase64(flags.String("harvester-user-data"))
@@ -293,6 +454,26 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.IsolateEmulatorThread = flags.Bool("harvester-isolate-emulator-thread")
 
 	d.EnableTPM = flags.Bool("harvester-enable-tpm")
+
+	d.SaveDiagnostics = flags.Bool("harvester-save-diagnostics")
+	d.KeepFailedMachine = flags.Bool("harvester-keep-failed-machine")
+
+	d.CreateTimeout = flags.Int("harvester-create-timeout")
+	d.StartTimeout = flags.Int("harvester-start-timeout")
+	d.StopTimeout = flags.Int("harvester-stop-timeout")
+	d.StopGracePeriod = flags.Int("harvester-stop-grace-period")
+	d.GuestAgentTimeout = flags.Int("harvester-guest-agent-timeout")
+	d.RestartTimeout = flags.Int("harvester-restart-timeout")
+	d.RemoveTimeout = flags.Int("harvester-remove-timeout")
+	d.MigrateTimeout = flags.Int("harvester-migrate-timeout")
+	d.ResizeTimeout = flags.Int("harvester-resize-timeout")
+	d.ExpandDiskTimeout = flags.Int("harvester-expand-disk-timeout")
+	d.HotplugTimeout = flags.Int("harvester-hotplug-timeout")
+	d.RemoveGracePeriod = flags.Int("harvester-remove-grace-period")
+	d.ForceRemoveFinalizers = flags.Bool("harvester-force-remove-finalizers")
+	d.RemoveBackupType = flags.String("harvester-remove-backup-type")
+	d.RemoveBackupTimeout = flags.Int("harvester-remove-backup-timeout")
+	d.RemoveCleanupTimeout = flags.Int("harvester-remove-cleanup-timeout")
 	return d.checkConfig()
 }
 
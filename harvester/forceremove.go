@@ -0,0 +1,200 @@
+package harvester
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/rancher/machine/libmachine/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/ptr"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	harvesterutil "github.com/harvester/harvester/pkg/util"
+)
+
+// cleanupPVCsFinalizer makes Harvester delete the claims listed in the removed
+// PVCs annotation of a VM once it is deleted, which the driver has to do
+// itself when the finalizer is stripped.
+const cleanupPVCsFinalizer = "wrangler.cattle.io/VMController.CleanupPVCAndSnapshot"
+
+// finalizers of KubeVirt and Harvester which force removal may strip from a VM
+// or VMI stuck terminating
+var knownFinalizers = map[string]struct{}{
+	kubevirtv1.VirtualMachineControllerFinalizer:         {},
+	kubevirtv1.VirtualMachineInstanceFinalizer:           {},
+	kubevirtv1.DeprecatedVirtualMachineInstanceFinalizer: {},
+	cleanupPVCsFinalizer:                                 {},
+	"wrangler.cattle.io/VMController.UnsetOwnerOfPVCs":   {},
+	"wrangler.cattle.io/VMIController.UnsetOwnerOfPVCs":  {},
+	"harvesterhci.io/VMController.UnsetOwnerOfPVCs":      {},
+}
+
+// waitRemovedOrForce waits for the VM to be removed. If the machine is
+// configured with a remove grace period and the VM is still there after it,
+// the VMI and virt-launcher pod are deleted forcefully before waiting again.
+func (d *Driver) waitRemovedOrForce() error {
+	if d.RemoveGracePeriod <= 0 {
+		return d.waitRemoved()
+	}
+	err := d.withTimeout("gracefully remove", d.RemoveGracePeriod, d.waitRemoved)
+	if err == nil || d.ctx.Err() != nil {
+		return err
+	}
+	log.Warnf("Machine %s was not removed gracefully within %ds, forcing its removal: %v", d.MachineName, d.RemoveGracePeriod, err)
+	if err = d.forceRemove(); err != nil {
+		return err
+	}
+	return d.waitRemoved()
+}
+
+func (d *Driver) forceRemove() error {
+	vmi, err := d.getVMI()
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		pods, err := d.listLauncherPods(vmi)
+		if err != nil {
+			return err
+		}
+		for _, pod := range pods {
+			log.Warnf("Force deleting virt-launcher pod %s/%s", pod.Namespace, pod.Name)
+			if err = d.forceDeletePod(pod.Name); err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+		}
+		log.Warnf("Force deleting vmi %s/%s", vmi.Namespace, vmi.Name)
+		if err = d.forceDeleteVMI(); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	if !d.ForceRemoveFinalizers {
+		return nil
+	}
+	if err = d.stripFinalizers(vmiResource); err != nil {
+		return err
+	}
+	return d.stripFinalizers(vmResource)
+}
+
+// stripFinalizers removes the known finalizers from the VM or VMI. The object
+// is read again right before every patch attempt, since deleting the pod and
+// VMI changes it, and the patch is pinned to that read so finalizers added in
+// the meantime are not overwritten.
+func (d *Driver) stripFinalizers(resource string) error {
+	c, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	var (
+		getMeta func() (*metav1.ObjectMeta, error)
+		patchFn func(patch []byte) error
+	)
+	switch resource {
+	case vmiResource:
+		vmis := c.HarvesterClient.KubevirtV1().VirtualMachineInstances(d.VMNamespace)
+		getMeta = func() (*metav1.ObjectMeta, error) {
+			vmi, err := vmis.Get(d.ctx, d.MachineName, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return &vmi.ObjectMeta, nil
+		}
+		patchFn = func(patch []byte) error {
+			_, err := vmis.Patch(d.ctx, d.MachineName, types.MergePatchType, patch, metav1.PatchOptions{})
+			return err
+		}
+	default:
+		vms := c.HarvesterClient.KubevirtV1().VirtualMachines(d.VMNamespace)
+		getMeta = func() (*metav1.ObjectMeta, error) {
+			vm, err := vms.Get(d.ctx, d.MachineName, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return &vm.ObjectMeta, nil
+		}
+		patchFn = func(patch []byte) error {
+			_, err := vms.Patch(d.ctx, d.MachineName, types.MergePatchType, patch, metav1.PatchOptions{})
+			return err
+		}
+	}
+
+	var removedPVCs []string
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		removedPVCs = nil
+		objectMeta, err := getMeta()
+		if err != nil {
+			return err
+		}
+		remaining := removeKnownFinalizers(objectMeta.Finalizers)
+		if len(remaining) == len(objectMeta.Finalizers) {
+			return nil
+		}
+		if slices.Contains(objectMeta.Finalizers, cleanupPVCsFinalizer) {
+			removedPVCs = strings.Split(objectMeta.Annotations[harvesterutil.RemovedPVCsAnnotationKey], ",")
+		}
+		for _, finalizer := range objectMeta.Finalizers {
+			if _, ok := knownFinalizers[finalizer]; ok {
+				log.Warnf("Removing finalizer %s from %s %s/%s", finalizer, resource, objectMeta.Namespace, objectMeta.Name)
+			}
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": objectMeta.ResourceVersion,
+				"finalizers":      remaining,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		return patchFn(patch)
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d.deleteRemovedPVCs(removedPVCs)
+	return nil
+}
+
+// deleteRemovedPVCs deletes the claims Harvester would have deleted with the
+// VM if its cleanup finalizer had not been stripped. Claims which cannot be
+// deleted are only reported, the removal goes on without them.
+func (d *Driver) deleteRemovedPVCs(claimNames []string) {
+	for _, claimName := range claimNames {
+		if claimName == "" {
+			continue
+		}
+		log.Infof("Deleting volume %s of machine %s in place of Harvester", claimName, d.MachineName)
+		if err := d.deletePVC(claimName); err != nil && !apierrors.IsNotFound(err) {
+			log.Warnf("Failed to delete volume %s/%s of machine %s, it is left behind: %v", d.VMNamespace, claimName, d.MachineName, err)
+		}
+	}
+}
+
+func removeKnownFinalizers(finalizers []string) []string {
+	remaining := make([]string, 0, len(finalizers))
+	for _, finalizer := range finalizers {
+		if _, ok := knownFinalizers[finalizer]; !ok {
+			remaining = append(remaining, finalizer)
+		}
+	}
+	return remaining
+}
+
+func (d *Driver) forceDeletePod(name string) error {
+	c, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	return c.KubeClient.CoreV1().Pods(d.VMNamespace).Delete(d.ctx, name, metav1.DeleteOptions{
+		GracePeriodSeconds: ptr.To[int64](0),
+	})
+}
@@ -0,0 +1,83 @@
+package harvester
+
+import (
+	"errors"
+	"testing"
+
+	harvesterutil "github.com/harvester/harvester/pkg/util"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func TestRemoveKnownFinalizers(t *testing.T) {
+	finalizers := []string{
+		kubevirtv1.VirtualMachineControllerFinalizer,
+		"example.com/keep-me",
+		"wrangler.cattle.io/VMController.CleanupPVCAndSnapshot",
+	}
+	require.Equal(t, []string{"example.com/keep-me"}, removeKnownFinalizers(finalizers))
+	require.Empty(t, removeKnownFinalizers(nil))
+}
+
+func TestStripFinalizersRetriesOnConflict(t *testing.T) {
+	vm := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "test-machine",
+			Namespace:       defaultNamespace,
+			ResourceVersion: "1",
+			Finalizers:      []string{kubevirtv1.VirtualMachineControllerFinalizer},
+		},
+	}
+	d, _, harvesterClient := newFakeDriver(vm)
+
+	// the first patch conflicts with a finalizer added in the meantime, which
+	// must survive the retry
+	patches := 0
+	harvesterClient.PrependReactor("patch", "virtualmachines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches++
+		if patches > 1 {
+			return false, nil, nil
+		}
+		changed := vm.DeepCopy()
+		changed.ResourceVersion = "2"
+		changed.Finalizers = append(changed.Finalizers, "example.com/keep-me")
+		require.NoError(t, harvesterClient.Tracker().Update(kubevirtv1.GroupVersion.WithResource("virtualmachines"), changed, defaultNamespace))
+		return true, nil, apierrors.NewConflict(kubevirtv1.Resource("virtualmachines"), vm.Name, errors.New("the object has been modified"))
+	})
+
+	require.NoError(t, d.stripFinalizers(vmResource))
+	require.Equal(t, 2, patches)
+	stripped, err := harvesterClient.KubevirtV1().VirtualMachines(defaultNamespace).Get(d.ctx, vm.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"example.com/keep-me"}, stripped.Finalizers)
+
+	// a VMI which is already gone has nothing to strip
+	require.NoError(t, d.stripFinalizers(vmiResource))
+}
+
+func TestStripCleanupFinalizerDeletesRemovedPVCs(t *testing.T) {
+	vm := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-machine",
+			Namespace:   defaultNamespace,
+			Finalizers:  []string{cleanupPVCsFinalizer},
+			Annotations: map[string]string{harvesterutil.RemovedPVCsAnnotationKey: "test-machine-disk-0,test-machine-disk-1"},
+		},
+	}
+	d, kubeClient, _ := newFakeDriver(
+		vm,
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "test-machine-disk-0", Namespace: defaultNamespace}},
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "retained-disk", Namespace: defaultNamespace}},
+	)
+
+	require.NoError(t, d.stripFinalizers(vmResource))
+	pvcs, err := kubeClient.CoreV1().PersistentVolumeClaims(defaultNamespace).List(d.ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, pvcs.Items, 1)
+	require.Equal(t, "retained-disk", pvcs.Items[0].Name)
+}
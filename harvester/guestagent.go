@@ -0,0 +1,82 @@
+package harvester
+
+import (
+	"time"
+
+	"github.com/rancher/machine/libmachine/log"
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const defaultGuestAgentTimeout = 120 // in seconds
+
+func isAgentConnected(vmi *kubevirtv1.VirtualMachineInstance) bool {
+	return agentConnectedCondition(vmi) != nil
+}
+
+// agentConnectedCondition returns the AgentConnected condition of the VMI if
+// the guest agent is connected.
+func agentConnectedCondition(vmi *kubevirtv1.VirtualMachineInstance) *kubevirtv1.VirtualMachineInstanceCondition {
+	for i, condition := range vmi.Status.Conditions {
+		if condition.Type == kubevirtv1.VirtualMachineInstanceAgentConnected && condition.Status == corev1.ConditionTrue {
+			return &vmi.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// requestStop asks KubeVirt to stop the VM. Once the guest OS is up, which a
+// connected agent tells, the stop is requested with a grace period of
+// GuestAgentTimeout seconds: virt-launcher sends an ACPI shutdown to the guest
+// and only powers it off when the grace period ends. KubeVirt offers no
+// shutdown through the guest agent, unlike the soft reboot.
+func (d *Driver) requestStop() error {
+	if d.GuestAgentTimeout <= 0 {
+		return d.putVMSubResource(actionStop)
+	}
+	vmi, err := d.getVMI()
+	if err != nil || !isAgentConnected(vmi) {
+		return d.putVMSubResource(actionStop)
+	}
+	log.Infof("Shutting down machine %s with an ACPI shutdown and a grace period of %ds", d.MachineName, d.GuestAgentTimeout)
+	return d.stopVMWithGracePeriod(int64(d.GuestAgentTimeout))
+}
+
+// softReboot reboots the guest through the guest agent and waits until the
+// agent has reconnected after the reboot. requested is when the reboot is
+// requested.
+func (d *Driver) softReboot(requested time.Time) error {
+	log.Infof("Rebooting machine %s through the guest agent", d.MachineName)
+	if err := d.putVMISubResource(actionSoftReboot); err != nil {
+		return err
+	}
+	return d.withTimeout("reboot", d.GuestAgentTimeout, func() error {
+		return d.waitForReboot(requested)
+	})
+}
+
+func (d *Driver) waitForReboot(requested time.Time) error {
+	rebooted := func() (bool, error) {
+		vmi, err := d.getVMI()
+		if err != nil {
+			return false, err
+		}
+		return agentReconnectedSince(vmi, requested), nil
+	}
+	log.Debugf("Waiting for node rebooted")
+	return d.waitFor("machine rebooted", rebooted)
+}
+
+// rebootStarted reports whether the guest acted on a reboot requested at
+// requested, so it is only slow to come back rather than stuck: its VMI was
+// replaced, or its guest agent disconnected or connected again since.
+func rebootStarted(vmi *kubevirtv1.VirtualMachineInstance, oldUID string, requested time.Time) bool {
+	return string(vmi.UID) != oldUID || !isAgentConnected(vmi) || agentReconnectedSince(vmi, requested)
+}
+
+// agentReconnectedSince reports whether the guest agent disconnected and
+// connected again after t, which happens when the guest reboots.
+func agentReconnectedSince(vmi *kubevirtv1.VirtualMachineInstance, t time.Time) bool {
+	condition := agentConnectedCondition(vmi)
+	return condition != nil && condition.LastTransitionTime.After(t)
+}
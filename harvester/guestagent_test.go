@@ -0,0 +1,59 @@
+package harvester
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func TestAgentReconnectedSince(t *testing.T) {
+	requested := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newVMI := func(status corev1.ConditionStatus, transition time.Time) *kubevirtv1.VirtualMachineInstance {
+		return &kubevirtv1.VirtualMachineInstance{
+			Status: kubevirtv1.VirtualMachineInstanceStatus{
+				Conditions: []kubevirtv1.VirtualMachineInstanceCondition{
+					{
+						Type:               kubevirtv1.VirtualMachineInstanceAgentConnected,
+						Status:             status,
+						LastTransitionTime: metav1.NewTime(transition),
+					},
+				},
+			},
+		}
+	}
+
+	require.False(t, agentReconnectedSince(&kubevirtv1.VirtualMachineInstance{}, requested))
+	require.False(t, agentReconnectedSince(newVMI(corev1.ConditionTrue, requested.Add(-time.Minute)), requested))
+	require.False(t, agentReconnectedSince(newVMI(corev1.ConditionFalse, requested.Add(time.Minute)), requested))
+	require.True(t, agentReconnectedSince(newVMI(corev1.ConditionTrue, requested.Add(time.Minute)), requested))
+	require.True(t, isAgentConnected(newVMI(corev1.ConditionTrue, requested)))
+}
+
+func TestRebootStarted(t *testing.T) {
+	requested := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newVMI := func(uid types.UID, status corev1.ConditionStatus, transition time.Time) *kubevirtv1.VirtualMachineInstance {
+		vmi := &kubevirtv1.VirtualMachineInstance{}
+		vmi.UID = uid
+		vmi.Status.Conditions = []kubevirtv1.VirtualMachineInstanceCondition{
+			{
+				Type:               kubevirtv1.VirtualMachineInstanceAgentConnected,
+				Status:             status,
+				LastTransitionTime: metav1.NewTime(transition),
+			},
+		}
+		return vmi
+	}
+
+	// the guest ignored the reboot, so it has to be restarted
+	require.False(t, rebootStarted(newVMI("old", corev1.ConditionTrue, requested.Add(-time.Minute)), "old", requested))
+	// the guest is shutting down or booting
+	require.True(t, rebootStarted(newVMI("old", corev1.ConditionFalse, requested.Add(time.Minute)), "old", requested))
+	require.True(t, rebootStarted(newVMI("old", corev1.ConditionTrue, requested.Add(time.Minute)), "old", requested))
+	// the VMI was replaced
+	require.True(t, rebootStarted(newVMI("new", corev1.ConditionTrue, requested.Add(-time.Minute)), "old", requested))
+}
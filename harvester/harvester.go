@@ -3,26 +3,36 @@ package harvester
 import (
 	"context"
 	"fmt"
-	"net"
-	"strings"
 	"time"
 
 	"github.com/rancher/machine/libmachine/drivers"
 	"github.com/rancher/machine/libmachine/log"
-	"github.com/rancher/machine/libmachine/mcnutils"
 	"github.com/rancher/machine/libmachine/state"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	"github.com/harvester/harvester/pkg/builder"
 )
 
 const (
-	driverName    = "harvester"
-	vmResource    = "virtualmachines"
-	actionStart   = "start"
-	actionStop    = "stop"
-	actionRestart = "restart"
+	driverName       = "harvester"
+	vmResource       = "virtualmachines"
+	vmiResource      = "virtualmachineinstances"
+	actionStart      = "start"
+	actionStop       = "stop"
+	actionRestart    = "restart"
+	actionPause      = "pause"
+	actionUnpause    = "unpause"
+	actionSoftReboot = "softreboot"
+
+	actionAddVolume    = "addvolume"
+	actionRemoveVolume = "removevolume"
 
 	removeAllPVCsAnnotationKey = "harvesterhci.io/removeAllPersistentVolumeClaims"
+	// deletionProtectionAnnotationKey makes Remove refuse to delete the VM
+	// while it is set to true
+	deletionProtectionAnnotationKey = "harvesterhci.io/deletionProtection"
 )
 
 // Driver is the driver used when no driver is selected. It is used to
@@ -53,7 +63,18 @@ type Driver struct {
 
 	ImageName string
 
-	DiskInfo *DiskInfo
+	DiskInfo         *DiskInfo
+	DiskRetainPolicy string
+
+	// RestoreFrom is the name of a VirtualMachineBackup, of type backup or
+	// snapshot, whose boot disk is restored in place of the image disk
+	RestoreFrom      string
+	RestoreDataDisks bool
+
+	// TemplateName is the VirtualMachineTemplate the machine is created
+	// from, the driver flags which are provided override the template
+	TemplateName    string
+	TemplateVersion int
 
 	KeyPairName       string
 	SSHPrivateKeyPath string
@@ -69,6 +90,9 @@ type Driver struct {
 
 	NetworkInfo *NetworkInfo
 
+	// IPFamily is the preferred family of the machine address, ipv4 or ipv6
+	IPFamily string
+
 	CloudConfig string
 	UserData    string
 	NetworkData string
@@ -81,6 +105,41 @@ type Driver struct {
 	IsolateEmulatorThread bool
 
 	EnableTPM bool
+
+	// operation timeouts in seconds, zero means the default timeout
+	CreateTimeout  int
+	StartTimeout   int
+	StopTimeout    int
+	RestartTimeout int
+	RemoveTimeout  int
+	MigrateTimeout int
+	ResizeTimeout  int
+
+	ExpandDiskTimeout int
+	HotplugTimeout    int
+
+	// StopGracePeriod is how many seconds Stop waits for the guest to shut
+	// down before killing it, zero means Stop never kills the machine
+	StopGracePeriod int
+	// GuestAgentTimeout is how many seconds Stop gives an ACPI shutdown and
+	// Restart a soft reboot of a booted guest, zero disables both
+	GuestAgentTimeout int
+	// RemoveGracePeriod is how many seconds Remove waits for the VM to be
+	// deleted before forcing it, zero means Remove never forces it
+	RemoveGracePeriod     int
+	ForceRemoveFinalizers bool
+	// RemoveBackupType is the type of the VirtualMachineBackup created before
+	// the machine is removed, only backup since snapshots are deleted with
+	// the VM, empty means no backup
+	RemoveBackupType    string
+	RemoveBackupTimeout int
+	// RemoveCleanupTimeout is how many seconds Remove waits for the volumes
+	// and secrets of the removed VM to be deleted, zero means the default
+	RemoveCleanupTimeout int
+
+	SaveDiagnostics bool
+	// KeepFailedMachine disables removing what Create made when it fails
+	KeepFailedMachine bool
 }
 
 func NewDriver(hostName, storePath string) *Driver {
@@ -98,6 +157,8 @@ func (d *Driver) DriverName() string {
 	return driverName
 }
 
+// GetSSHHostname returns the machine address, IPv6 addresses are returned
+// without brackets since the SSH clients join them with the port.
 func (d *Driver) GetSSHHostname() (string, error) {
 	return d.GetIP()
 }
@@ -112,7 +173,7 @@ func (d *Driver) GetURL() (string, error) {
 		return "", err
 	}
 
-	return fmt.Sprintf("tcp://%s", net.JoinHostPort(ip, "2376")), nil
+	return dockerURL(ip), nil
 }
 
 func (d *Driver) GetIP() (string, error) {
@@ -124,20 +185,34 @@ func (d *Driver) GetIP() (string, error) {
 	if err != nil {
 		return "", err
 	}
-
-	addr := strings.Split(vmi.Status.Interfaces[0].IP, "/")[0]
-	if ip := net.ParseIP(addr); ip == nil || ip.To4() == nil {
-		return "", fmt.Errorf("%s is not a valid IPv4 address", addr)
+	name, iface, err := managementInterface(vmi, d.managementInterfaceName())
+	if err != nil {
+		return "", err
 	}
 
-	return addr, nil
+	addresses, err := interfaceAddresses(*iface)
+	if err != nil {
+		return "", err
+	}
+	addr, err := selectAddress(usableAddresses(addresses, d.networkSubnets(vmi, name)), d.IPFamily, d.IPAddress)
+	if err != nil {
+		return "", fmt.Errorf("interface %s of machine %s: %w", name, d.MachineName, err)
+	}
+	// record the address, so that it stays the same while it is reported
+	d.IPAddress = addr.String()
+	return d.IPAddress, nil
 }
 
 func (d *Driver) GetState() (state.State, error) {
-	if _, err := d.getVM(); err != nil {
+	vm, err := d.getVM()
+	if err != nil {
 		return state.None, err
 	}
+	if vmState, err := getStateFromVM(vm); vmState != state.None {
+		return vmState, err
+	}
 
+	// fall back to the VMI phase if the VM status is not known
 	vmi, err := d.getVMI()
 	if err != nil {
 		if apierrors.IsNotFound(err) {
@@ -153,6 +228,11 @@ func getStateFormVMI(vmi *kubevirtv1.VirtualMachineInstance) state.State {
 	case "Pending", "Scheduling", "Scheduled":
 		return state.Starting
 	case "Running":
+		for _, condition := range vmi.Status.Conditions {
+			if condition.Type == kubevirtv1.VirtualMachineInstancePaused && condition.Status == corev1.ConditionTrue {
+				return state.Paused
+			}
+		}
 		return state.Running
 	case "Succeeded":
 		return state.Stopping
@@ -163,23 +243,94 @@ func getStateFormVMI(vmi *kubevirtv1.VirtualMachineInstance) state.State {
 	}
 }
 
+// getStateFromVM maps the printable status of the VM to a machine state. For
+// error states the returned error carries the reason reported by KubeVirt.
+// state.None is returned if the printable status is empty or unknown.
+func getStateFromVM(vm *kubevirtv1.VirtualMachine) (state.State, error) {
+	switch vm.Status.PrintableStatus {
+	case kubevirtv1.VirtualMachineStatusStopped:
+		return state.Stopped, nil
+	case kubevirtv1.VirtualMachineStatusProvisioning,
+		kubevirtv1.VirtualMachineStatusStarting,
+		kubevirtv1.VirtualMachineStatusWaitingForVolumeBinding,
+		kubevirtv1.VirtualMachineStatusWaitingForReceiver:
+		return state.Starting, nil
+	case kubevirtv1.VirtualMachineStatusRunning,
+		kubevirtv1.VirtualMachineStatusMigrating:
+		return state.Running, nil
+	case kubevirtv1.VirtualMachineStatusPaused:
+		return state.Paused, nil
+	case kubevirtv1.VirtualMachineStatusStopping,
+		kubevirtv1.VirtualMachineStatusTerminating:
+		return state.Stopping, nil
+	case kubevirtv1.VirtualMachineStatusCrashLoopBackOff,
+		kubevirtv1.VirtualMachineStatusUnschedulable,
+		kubevirtv1.VirtualMachineStatusErrImagePull,
+		kubevirtv1.VirtualMachineStatusImagePullBackOff,
+		kubevirtv1.VirtualMachineStatusPvcNotFound,
+		kubevirtv1.VirtualMachineStatusDataVolumeError:
+		if reason := getVMConditionReason(vm); reason != "" {
+			return state.Error, fmt.Errorf("machine %s is %s: %s", vm.Name, vm.Status.PrintableStatus, reason)
+		}
+		return state.Error, fmt.Errorf("machine %s is %s", vm.Name, vm.Status.PrintableStatus)
+	default:
+		return state.None, nil
+	}
+}
+
+// getVMConditionReason returns the reason of a failing VM, preferring the
+// Failure condition over any other condition which is not met.
+func getVMConditionReason(vm *kubevirtv1.VirtualMachine) string {
+	formatCondition := func(condition kubevirtv1.VirtualMachineCondition) string {
+		if condition.Message == "" {
+			return condition.Reason
+		}
+		if condition.Reason == "" {
+			return condition.Message
+		}
+		return fmt.Sprintf("%s: %s", condition.Reason, condition.Message)
+	}
+
+	for _, condition := range vm.Status.Conditions {
+		if condition.Type == kubevirtv1.VirtualMachineFailure && condition.Status == corev1.ConditionTrue {
+			return formatCondition(condition)
+		}
+	}
+	for _, condition := range vm.Status.Conditions {
+		if condition.Status == corev1.ConditionFalse && condition.Message != "" {
+			return formatCondition(condition)
+		}
+	}
+	return ""
+}
+
 func (d *Driver) waitRemoved() error {
-	removed := func() bool {
+	removed := func() (bool, error) {
 		if _, err := d.getVM(); err != nil {
 			if apierrors.IsNotFound(err) {
-				return true
+				return true, nil
 			}
+			return false, err
 		}
-		return false
+		return false, nil
 	}
 	log.Debugf("Waiting for node removed")
-	if err := mcnutils.WaitForSpecific(removed, 120, 5*time.Second); err != nil {
-		return fmt.Errorf("too many retries waiting for machine removed.  Last error: %s", err)
+	if err := d.waitFor("machine removed", removed); err != nil {
+		return err
 	}
 	return nil
 }
 
 func (d *Driver) Remove() error {
+	if d.RemoveBackupType != "" {
+		if err := d.withTimeout(operationBackup, d.RemoveBackupTimeout, d.backupBeforeRemove); err != nil {
+			return err
+		}
+	}
+	return d.withTimeout(operationRemove, d.RemoveTimeout, d.remove)
+}
+
+func (d *Driver) remove() error {
 	log.Debugf("Remove node")
 	vm, err := d.getVM()
 	if err != nil {
@@ -188,17 +339,71 @@ func (d *Driver) Remove() error {
 		}
 		return err
 	}
+	if err = d.checkRemovableVM(vm); err != nil {
+		return err
+	}
+	return d.removeVM(vm, true)
+}
+
+// checkRemovableVM makes sure Remove only deletes a VM this driver created for
+// the machine, and that the VM is not protected from deletion.
+func (d *Driver) checkRemovableVM(vm *kubevirtv1.VirtualMachine) error {
+	// VMs created before the machine name annotation was introduced only
+	// carry the creator label
+	if vm.Labels[builder.LabelKeyVirtualMachineCreator] != vmCreator {
+		return fmt.Errorf("refusing to remove vm %s/%s: it was not created by this driver", vm.Namespace, vm.Name)
+	}
+	if machineName, ok := vm.Annotations[machineNameAnnotationKey]; ok && machineName != d.MachineName {
+		return fmt.Errorf("refusing to remove vm %s/%s: it was created for machine %s", vm.Namespace, vm.Name, machineName)
+	}
+	if d.ClusterName != "" && vm.Labels[clusterNameLabelKey] != d.ClusterName {
+		return fmt.Errorf("refusing to remove vm %s/%s: it does not belong to cluster %s", vm.Namespace, vm.Name, d.ClusterName)
+	}
+	if vm.Annotations[deletionProtectionAnnotationKey] == "true" {
+		return fmt.Errorf("refusing to remove vm %s/%s: deletion protection is enabled, remove the %s annotation to delete it", vm.Namespace, vm.Name, deletionProtectionAnnotationKey)
+	}
+	return nil
+}
 
-	if _, err = d.patchRemovedPVCs(vm); err != nil {
+// removeVM deletes the VM together with its volumes and waits until the VM,
+// and then its volumes and cloud-init secret, are gone. If retainDisks is set,
+// volumes with the retain policy are kept. Leftover volumes and secrets are
+// logged as a warning.
+func (d *Driver) removeVM(vm *kubevirtv1.VirtualMachine, retainDisks bool) error {
+	hotplugged, err := d.hotpluggedClaims(vm)
+	if err != nil {
+		return err
+	}
+	retained := map[string]string{}
+	if retainDisks {
+		retained = d.retainedPVCs(vm, hotplugged)
+	}
+	patchedVM, err := d.patchRemovedPVCs(vm, hotplugged, retained)
+	if err != nil {
+		return err
+	}
+	if err = d.retainPVCs(vm, retained); err != nil {
+		return err
+	}
+	dependents, err := d.removalDependents(patchedVM)
+	if err != nil {
 		return err
 	}
 	if err = d.deleteVM(); err != nil {
 		return err
 	}
-	return d.waitRemoved()
+	if err = d.waitRemovedOrForce(); err != nil {
+		return err
+	}
+	d.waitDependentsRemoved(dependents)
+	return nil
 }
 
 func (d *Driver) Restart() error {
+	return d.withTimeout(operationRestart, d.RestartTimeout, d.restart)
+}
+
+func (d *Driver) restart() error {
 	log.Debugf("Restart node")
 	vmi, err := d.getVMI()
 	if err != nil {
@@ -206,6 +411,21 @@ func (d *Driver) Restart() error {
 	}
 	oldUID := string(vmi.UID)
 
+	if d.GuestAgentTimeout > 0 && isAgentConnected(vmi) {
+		// condition transition times have a resolution of seconds
+		requested := time.Now().Truncate(time.Second)
+		err = d.softReboot(requested)
+		if err == nil || d.ctx.Err() != nil {
+			return err
+		}
+		// power cycling a guest which is still rebooting could corrupt it
+		if vmi, getErr := d.getVMI(); getErr == nil && rebootStarted(vmi, oldUID, requested) {
+			log.Warnf("Machine %s is still rebooting through the guest agent, waiting for it: %v", d.MachineName, err)
+			return d.waitForReboot(requested)
+		}
+		log.Warnf("Failed to reboot machine %s through the guest agent, restarting it: %v", d.MachineName, err)
+	}
+
 	if err = d.putVMSubResource(actionRestart); err != nil {
 		return err
 	}
@@ -214,6 +434,10 @@ func (d *Driver) Restart() error {
 }
 
 func (d *Driver) Start() error {
+	return d.withTimeout(operationStart, d.StartTimeout, d.start)
+}
+
+func (d *Driver) start() error {
 	log.Debugf("Start node")
 	if err := d.putVMSubResource(actionStart); err != nil {
 		return err
@@ -222,13 +446,79 @@ func (d *Driver) Start() error {
 }
 
 func (d *Driver) Stop() error {
+	return d.withTimeout(operationStop, d.StopTimeout, d.stop)
+}
+
+func (d *Driver) stop() error {
 	log.Debugf("Stop node")
-	if err := d.putVMSubResource(actionStop); err != nil {
+	if err := d.requestStop(); err != nil {
 		return err
 	}
-	return d.waitForState(state.Stopped)
+	if d.StopGracePeriod <= 0 {
+		return d.waitForState(state.Stopped)
+	}
+
+	err := d.withTimeout("gracefully stop", d.StopGracePeriod, func() error {
+		return d.waitForState(state.Stopped)
+	})
+	if err == nil || d.ctx.Err() != nil {
+		return err
+	}
+	log.Warnf("Machine %s did not stop gracefully within %ds, killing it: %v", d.MachineName, d.StopGracePeriod, err)
+	return d.kill()
 }
 
 func (d *Driver) Kill() error {
-	return d.Stop()
+	return d.withTimeout(operationKill, d.StopTimeout, d.kill)
+}
+
+func (d *Driver) kill() error {
+	log.Debugf("Kill node")
+	// a conflict means the VM is already halted with the same grace period
+	if err := d.forceStopVM(); err != nil && !apierrors.IsConflict(err) {
+		return err
+	}
+	// the guest may be too wedged to honor the new grace period
+	if err := d.forceDeleteVMI(); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return d.waitForState(state.Stopped)
+}
+
+// Pause freezes the guest while keeping its memory state, so a misbehaving
+// machine can be inspected later. It is run by the pause command.
+func (d *Driver) Pause() error {
+	return d.withTimeout(operationPause, d.StopTimeout, d.pause)
+}
+
+func (d *Driver) pause() error {
+	log.Debugf("Pause node")
+	if err := drivers.MustBeRunning(d); err != nil {
+		return err
+	}
+	if err := d.putVMISubResource(actionPause); err != nil {
+		return err
+	}
+	return d.waitForState(state.Paused)
+}
+
+// Unpause resumes a machine frozen by Pause. It is run by the unpause
+// command.
+func (d *Driver) Unpause() error {
+	return d.withTimeout(operationUnpause, d.StartTimeout, d.unpause)
+}
+
+func (d *Driver) unpause() error {
+	log.Debugf("Unpause node")
+	currentState, err := d.GetState()
+	if err != nil {
+		return err
+	}
+	if currentState != state.Paused {
+		return fmt.Errorf("machine %s is not paused, current state is %s", d.MachineName, currentState)
+	}
+	if err = d.putVMISubResource(actionUnpause); err != nil {
+		return err
+	}
+	return d.waitForState(state.Running)
 }
@@ -0,0 +1,192 @@
+package harvester
+
+import (
+	"testing"
+
+	"github.com/rancher/machine/libmachine/state"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	"github.com/harvester/harvester/pkg/builder"
+)
+
+func TestGetStateFromVM(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     kubevirtv1.VirtualMachineStatus
+		wantState  state.State
+		wantErrMsg string
+	}{
+		{
+			name:      "unknown status",
+			status:    kubevirtv1.VirtualMachineStatus{},
+			wantState: state.None,
+		},
+		{
+			name:      "stopped",
+			status:    kubevirtv1.VirtualMachineStatus{PrintableStatus: kubevirtv1.VirtualMachineStatusStopped},
+			wantState: state.Stopped,
+		},
+		{
+			name:      "waiting for volume binding",
+			status:    kubevirtv1.VirtualMachineStatus{PrintableStatus: kubevirtv1.VirtualMachineStatusWaitingForVolumeBinding},
+			wantState: state.Starting,
+		},
+		{
+			name:      "migrating",
+			status:    kubevirtv1.VirtualMachineStatus{PrintableStatus: kubevirtv1.VirtualMachineStatusMigrating},
+			wantState: state.Running,
+		},
+		{
+			name:      "paused",
+			status:    kubevirtv1.VirtualMachineStatus{PrintableStatus: kubevirtv1.VirtualMachineStatusPaused},
+			wantState: state.Paused,
+		},
+		{
+			name: "unschedulable",
+			status: kubevirtv1.VirtualMachineStatus{
+				PrintableStatus: kubevirtv1.VirtualMachineStatusUnschedulable,
+				Conditions: []kubevirtv1.VirtualMachineCondition{
+					{
+						Type:   kubevirtv1.VirtualMachineReady,
+						Status: corev1.ConditionFalse,
+						Reason: "GuestNotRunning",
+					},
+					{
+						Type:    kubevirtv1.VirtualMachineConditionType(corev1.PodScheduled),
+						Status:  corev1.ConditionFalse,
+						Reason:  "Unschedulable",
+						Message: "0/3 nodes are available: 3 Insufficient memory.",
+					},
+				},
+			},
+			wantState:  state.Error,
+			wantErrMsg: "machine test-machine is ErrorUnschedulable: Unschedulable: 0/3 nodes are available: 3 Insufficient memory.",
+		},
+		{
+			name: "failure condition is preferred",
+			status: kubevirtv1.VirtualMachineStatus{
+				PrintableStatus: kubevirtv1.VirtualMachineStatusDataVolumeError,
+				Conditions: []kubevirtv1.VirtualMachineCondition{
+					{
+						Type:    kubevirtv1.VirtualMachineReady,
+						Status:  corev1.ConditionFalse,
+						Message: "VMI does not exist",
+					},
+					{
+						Type:    kubevirtv1.VirtualMachineFailure,
+						Status:  corev1.ConditionTrue,
+						Message: "DataVolume test-machine-disk-0 failed to import",
+					},
+				},
+			},
+			wantState:  state.Error,
+			wantErrMsg: "machine test-machine is DataVolumeError: DataVolume test-machine-disk-0 failed to import",
+		},
+		{
+			name:       "error without reason",
+			status:     kubevirtv1.VirtualMachineStatus{PrintableStatus: kubevirtv1.VirtualMachineStatusErrImagePull},
+			wantState:  state.Error,
+			wantErrMsg: "machine test-machine is ErrImagePull",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &kubevirtv1.VirtualMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-machine"},
+				Status:     tt.status,
+			}
+			gotState, err := getStateFromVM(vm)
+			require.Equal(t, tt.wantState, gotState)
+			if tt.wantErrMsg == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.wantErrMsg)
+			}
+		})
+	}
+}
+
+func TestGetStateFormVMI(t *testing.T) {
+	vmi := &kubevirtv1.VirtualMachineInstance{
+		Status: kubevirtv1.VirtualMachineInstanceStatus{Phase: kubevirtv1.Running},
+	}
+	require.Equal(t, state.Running, getStateFormVMI(vmi))
+
+	vmi.Status.Conditions = []kubevirtv1.VirtualMachineInstanceCondition{
+		{
+			Type:   kubevirtv1.VirtualMachineInstancePaused,
+			Status: corev1.ConditionTrue,
+		},
+	}
+	require.Equal(t, state.Paused, getStateFormVMI(vmi))
+}
+
+func TestCheckRemovableVM(t *testing.T) {
+	d := NewDriver("test-cluster-pool1-abcde-fghij", "")
+	d.ClusterName = "test-cluster"
+	newVM := func(labels, annotations map[string]string) *kubevirtv1.VirtualMachine {
+		return &kubevirtv1.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        d.MachineName,
+				Labels:      labels,
+				Annotations: annotations,
+			},
+		}
+	}
+	ownedLabels := map[string]string{
+		builder.LabelKeyVirtualMachineCreator: vmCreator,
+		clusterNameLabelKey:                   "test-cluster",
+	}
+
+	tests := []struct {
+		name       string
+		vm         *kubevirtv1.VirtualMachine
+		wantErrMsg string
+	}{
+		{
+			name: "owned",
+			vm:   newVM(ownedLabels, map[string]string{machineNameAnnotationKey: d.MachineName}),
+		},
+		{
+			name: "owned without machine name annotation",
+			vm:   newVM(ownedLabels, nil),
+		},
+		{
+			name:       "created by another creator",
+			vm:         newVM(map[string]string{builder.LabelKeyVirtualMachineCreator: "harvester"}, nil),
+			wantErrMsg: "it was not created by this driver",
+		},
+		{
+			name:       "created for another machine",
+			vm:         newVM(ownedLabels, map[string]string{machineNameAnnotationKey: "other-machine"}),
+			wantErrMsg: "it was created for machine other-machine",
+		},
+		{
+			name: "belongs to another cluster",
+			vm: newVM(map[string]string{
+				builder.LabelKeyVirtualMachineCreator: vmCreator,
+				clusterNameLabelKey:                   "other-cluster",
+			}, nil),
+			wantErrMsg: "it does not belong to cluster test-cluster",
+		},
+		{
+			name:       "deletion protection",
+			vm:         newVM(ownedLabels, map[string]string{deletionProtectionAnnotationKey: "true"}),
+			wantErrMsg: "deletion protection is enabled",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := d.checkRemovableVM(tt.vm)
+			if tt.wantErrMsg == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tt.wantErrMsg)
+			}
+		})
+	}
+}
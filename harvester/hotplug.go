@@ -0,0 +1,301 @@
+package harvester
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/harvester/harvester/pkg/builder"
+	"github.com/rancher/machine/libmachine/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/utils/ptr"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const hotplugDiskBus = "scsi"
+
+// AddVolume creates a volume as described by disk and hotplugs it into the
+// machine without restarting it, and returns the name of the new disk. When
+// the machine is removed, the volume is deleted or retained according to the
+// retain policy of disk. It is run by the add-volume command.
+func (d *Driver) AddVolume(disk Disk) (string, error) {
+	var diskName string
+	err := d.withTimeout(operationAddVolume, d.HotplugTimeout, func() error {
+		var err error
+		diskName, err = d.addVolume(disk)
+		return err
+	})
+	return diskName, err
+}
+
+func (d *Driver) addVolume(disk Disk) (string, error) {
+	log.Debugf("Add node volume")
+	if err := checkHotplugDisk(&disk); err != nil {
+		return "", err
+	}
+	vm, err := d.getVM()
+	if err != nil {
+		return "", err
+	}
+	index := nextDiskIndex(vm)
+	diskName := fmt.Sprintf("%s-%d", diskNamePrefix, index)
+	pvc, err := d.hotplugPVC(&disk, diskName)
+	if err != nil {
+		return "", err
+	}
+	if pvc, err = d.createPVC(pvc); err != nil {
+		return "", err
+	}
+	log.Infof("Adding disk %s of %dGi to machine %s", diskName, disk.Size, d.MachineName)
+	if err = d.addVolumeToVM(hotplugVolumeOptions(diskName, disk.Bus, pvc.Name)); err != nil {
+		if deleteErr := d.deletePVC(pvc.Name); deleteErr != nil {
+			log.Warnf("Failed to delete volume %s: %v", pvc.Name, deleteErr)
+		}
+		return "", err
+	}
+
+	if _, err = d.getVMI(); err == nil {
+		if err = d.waitForVolume(diskName, true); err != nil {
+			return "", err
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return "", err
+	}
+	if d.DiskInfo != nil {
+		disk.HotPlugAble = true
+		switch {
+		case index == len(d.DiskInfo.Disks):
+			d.DiskInfo.Disks = append(d.DiskInfo.Disks, disk)
+		case index < len(d.DiskInfo.Disks):
+			// the entry of a removed disk whose index is reused
+			d.DiskInfo.Disks[index] = disk
+		}
+	}
+	log.Infof("Added disk %s to machine %s", diskName, d.MachineName)
+	return diskName, nil
+}
+
+// RemoveVolume detaches the hotplugged disk with the given name, such as
+// disk-2, from the machine without restarting it. The volume is then deleted
+// or retained according to the disk retain policy. It is run by the
+// remove-volume command.
+func (d *Driver) RemoveVolume(diskName string) error {
+	return d.withTimeout(operationRemoveVolume, d.HotplugTimeout, func() error {
+		return d.removeVolume(diskName)
+	})
+}
+
+func (d *Driver) removeVolume(diskName string) error {
+	log.Debugf("Remove node volume %s", diskName)
+	vm, err := d.getVM()
+	if err != nil {
+		return err
+	}
+	claimName, err := hotpluggedClaimName(vm, diskName)
+	if err != nil {
+		return err
+	}
+	log.Infof("Removing disk %s from machine %s", diskName, d.MachineName)
+	if err = d.removeVolumeFromVM(diskName); err != nil {
+		return err
+	}
+	if err = d.waitForVolume(diskName, false); err != nil {
+		return err
+	}
+
+	hotplugged, err := d.hotpluggedClaims(vm)
+	if err != nil {
+		return err
+	}
+	policy, ok := hotplugged[claimName]
+	if !ok {
+		policy = d.diskRetainPolicy(diskName)
+	}
+	d.forgetDisk(diskName)
+	if policy == diskRetainPolicyRetain {
+		return d.retainPVCs(vm, map[string]string{claimName: diskName})
+	}
+	if err = d.deletePVC(claimName); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	log.Infof("Removed disk %s and its volume %s from machine %s", diskName, claimName, d.MachineName)
+	return nil
+}
+
+// forgetDisk drops the disk with the given name from the disk info, so its
+// retain policy does not apply to a disk added later with the same name.
+func (d *Driver) forgetDisk(diskName string) {
+	index, ok := diskIndex(diskName)
+	if !ok || d.DiskInfo == nil || index >= len(d.DiskInfo.Disks) {
+		return
+	}
+	if index == len(d.DiskInfo.Disks)-1 {
+		d.DiskInfo.Disks = d.DiskInfo.Disks[:index]
+	} else {
+		d.DiskInfo.Disks[index] = Disk{}
+	}
+}
+
+// checkHotplugDisk checks that disk can be hotplugged and fills its defaults.
+func checkHotplugDisk(disk *Disk) error {
+	if disk.ImageName == "" && disk.StorageClassName == "" {
+		return errors.New("must specify image name or storageClass name of the hotplugged disk")
+	}
+	if disk.Size <= 0 {
+		return errors.New("must specify disk size of the hotplugged disk")
+	}
+	if err := checkDiskRetainPolicy(disk.RetainPolicy); err != nil {
+		return err
+	}
+	if disk.Type != "" && disk.Type != builder.DiskTypeDisk {
+		return fmt.Errorf("disk type %s cannot be hotplugged", disk.Type)
+	}
+	disk.Type = builder.DiskTypeDisk
+	switch disk.Bus {
+	case "":
+		disk.Bus = hotplugDiskBus
+	case hotplugDiskBus, string(kubevirtv1.DiskBusVirtio):
+	default:
+		return fmt.Errorf("disks on bus %s cannot be hotplugged, use %s or %s", disk.Bus, hotplugDiskBus, kubevirtv1.DiskBusVirtio)
+	}
+	if disk.BootOrder != 0 {
+		return errors.New("hotplugged disks cannot have a boot order")
+	}
+	return nil
+}
+
+// nextDiskIndex returns the index following those of the disks of vm built
+// by addDisk.
+func nextDiskIndex(vm *kubevirtv1.VirtualMachine) int {
+	next := 0
+	for _, volume := range vm.Spec.Template.Spec.Volumes {
+		if index, ok := diskIndex(volume.Name); ok && index >= next {
+			next = index + 1
+		}
+	}
+	return next
+}
+
+// hotplugPVC returns the claim of the hotplugged disk, built like the claims
+// of the disks added by addDisk.
+func (d *Driver) hotplugPVC(disk *Disk, diskName string) (*corev1.PersistentVolumeClaim, error) {
+	annotations := map[string]string{}
+	if disk.ImageName != "" {
+		imageNamespace, imageName, err := NamespacedNamePartsByDefault(disk.ImageName, d.VMNamespace)
+		if err != nil {
+			return nil, err
+		}
+		image, err := d.getImage(disk.ImageName)
+		if err != nil {
+			return nil, err
+		}
+		annotations[builder.AnnotationKeyImageID] = fmt.Sprintf("%s/%s", imageNamespace, imageName)
+		disk.StorageClassName = image.Status.StorageClassName
+	}
+	// the claim is marked as the machine's, so Remove deletes or retains it
+	annotations[machineNameAnnotationKey] = d.MachineName
+	annotations[diskRetainPolicyAnnotationKey] = disk.RetainPolicy
+	if disk.RetainPolicy == "" {
+		annotations[diskRetainPolicyAnnotationKey] = d.diskRetainPolicy("")
+	}
+	labels := map[string]string{}
+	if d.ClusterName != "" {
+		labels[clusterNameLabelKey] = d.ClusterName
+	}
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("%s-%s-%s", d.MachineName, diskName, rand.String(5)),
+			Namespace:   d.VMNamespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: *resource.NewQuantity(int64(disk.Size)<<30, resource.BinarySI),
+				},
+			},
+			VolumeMode:       ptr.To(corev1.PersistentVolumeBlock),
+			StorageClassName: ptr.To(disk.StorageClassName),
+		},
+	}, nil
+}
+
+// hotplugVolumeOptions returns the options hotplugging the claim as the disk
+// with the given name.
+func hotplugVolumeOptions(diskName, bus, claimName string) *kubevirtv1.AddVolumeOptions {
+	return &kubevirtv1.AddVolumeOptions{
+		Name: diskName,
+		Disk: &kubevirtv1.Disk{
+			Name: diskName,
+			DiskDevice: kubevirtv1.DiskDevice{
+				Disk: &kubevirtv1.DiskTarget{Bus: kubevirtv1.DiskBus(bus)},
+			},
+		},
+		VolumeSource: &kubevirtv1.HotplugVolumeSource{
+			PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
+				PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+				Hotpluggable:                      true,
+			},
+		},
+	}
+}
+
+// hotpluggedClaimName returns the claim of the hotplugged disk of vm with the
+// given name. Disks attached when the VM was created cannot be detached live.
+func hotpluggedClaimName(vm *kubevirtv1.VirtualMachine, diskName string) (string, error) {
+	for _, volume := range vm.Spec.Template.Spec.Volumes {
+		if volume.Name != diskName {
+			continue
+		}
+		if volume.PersistentVolumeClaim == nil || !volume.PersistentVolumeClaim.Hotpluggable {
+			return "", fmt.Errorf("disk %s of machine %s is not hotplugged, it cannot be removed from the running machine", diskName, vm.Name)
+		}
+		return volume.PersistentVolumeClaim.ClaimName, nil
+	}
+	return "", fmt.Errorf("disk %s not found in machine %s", diskName, vm.Name)
+}
+
+// waitForVolume waits for the disk with the given name to be attached to the
+// running machine and ready, or to be detached from the machine.
+func (d *Driver) waitForVolume(diskName string, attached bool) error {
+	done := func() (bool, error) {
+		vm, err := d.getVM()
+		if err != nil {
+			return false, err
+		}
+		inSpec := false
+		for _, volume := range vm.Spec.Template.Spec.Volumes {
+			if volume.Name == diskName {
+				inSpec = true
+				break
+			}
+		}
+		if inSpec != attached {
+			return false, nil
+		}
+		vmi, err := d.getVMI()
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return !attached, nil
+			}
+			return false, err
+		}
+		for _, status := range vmi.Status.VolumeStatus {
+			if status.Name == diskName {
+				return attached && status.Phase == kubevirtv1.VolumeReady, nil
+			}
+		}
+		return !attached, nil
+	}
+	if attached {
+		log.Debugf("Waiting for node disk %s attached", diskName)
+		return d.waitFor(fmt.Sprintf("disk %s attached", diskName), done)
+	}
+	log.Debugf("Waiting for node disk %s detached", diskName)
+	return d.waitFor(fmt.Sprintf("disk %s detached", diskName), done)
+}
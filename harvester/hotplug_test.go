@@ -0,0 +1,263 @@
+package harvester
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	harvfake "github.com/harvester/harvester/pkg/generated/clientset/versioned/fake"
+	"github.com/harvester/harvester/pkg/generated/clientset/versioned/scheme"
+	harvesterutil "github.com/harvester/harvester/pkg/util"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func testHotplugVM() *kubevirtv1.VirtualMachine {
+	return &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-machine"},
+		Spec: kubevirtv1.VirtualMachineSpec{
+			Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
+				Spec: kubevirtv1.VirtualMachineInstanceSpec{
+					Volumes: []kubevirtv1.Volume{
+						{
+							Name: "disk-0",
+							VolumeSource: kubevirtv1.VolumeSource{
+								PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
+									PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{ClaimName: "test-machine-disk-0-abcde"},
+								},
+							},
+						},
+						{
+							Name: "disk-2",
+							VolumeSource: kubevirtv1.VolumeSource{
+								PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
+									PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{ClaimName: "test-machine-disk-2-fghij"},
+									Hotpluggable:                      true,
+								},
+							},
+						},
+						{
+							Name:         "cloudinitdisk",
+							VolumeSource: kubevirtv1.VolumeSource{CloudInitNoCloud: &kubevirtv1.CloudInitNoCloudSource{}},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestNextDiskIndex(t *testing.T) {
+	require.Equal(t, 3, nextDiskIndex(testHotplugVM()))
+	require.Equal(t, 0, nextDiskIndex(&kubevirtv1.VirtualMachine{Spec: kubevirtv1.VirtualMachineSpec{
+		Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{},
+	}}))
+}
+
+func TestHotpluggedClaimName(t *testing.T) {
+	vm := testHotplugVM()
+	claimName, err := hotpluggedClaimName(vm, "disk-2")
+	require.NoError(t, err)
+	require.Equal(t, "test-machine-disk-2-fghij", claimName)
+
+	_, err = hotpluggedClaimName(vm, "disk-0")
+	require.EqualError(t, err, "disk disk-0 of machine test-machine is not hotplugged, it cannot be removed from the running machine")
+	_, err = hotpluggedClaimName(vm, "disk-5")
+	require.EqualError(t, err, "disk disk-5 not found in machine test-machine")
+}
+
+func TestCheckHotplugDisk(t *testing.T) {
+	tests := []struct {
+		name string
+		disk Disk
+		bus  string
+		err  string
+	}{
+		{
+			name: "default bus",
+			disk: Disk{StorageClassName: "longhorn", Size: 10},
+			bus:  hotplugDiskBus,
+		},
+		{
+			name: "virtio bus",
+			disk: Disk{ImageName: "default/ubuntu", Size: 10, Bus: "virtio"},
+			bus:  "virtio",
+		},
+		{
+			name: "sata bus",
+			disk: Disk{StorageClassName: "longhorn", Size: 10, Bus: "sata"},
+			err:  "disks on bus sata cannot be hotplugged, use scsi or virtio",
+		},
+		{
+			name: "cd-rom",
+			disk: Disk{StorageClassName: "longhorn", Size: 10, Type: "cd-rom"},
+			err:  "disk type cd-rom cannot be hotplugged",
+		},
+		{
+			name: "no size",
+			disk: Disk{StorageClassName: "longhorn"},
+			err:  "must specify disk size of the hotplugged disk",
+		},
+		{
+			name: "boot order",
+			disk: Disk{StorageClassName: "longhorn", Size: 10, BootOrder: 1},
+			err:  "hotplugged disks cannot have a boot order",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkHotplugDisk(&tt.disk)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.bus, tt.disk.Bus)
+		})
+	}
+}
+
+func TestHotplugVolumeOptions(t *testing.T) {
+	options := hotplugVolumeOptions("disk-3", hotplugDiskBus, "test-machine-disk-3-abcde")
+	require.Equal(t, "disk-3", options.Name)
+	require.Equal(t, "disk-3", options.Disk.Name)
+	require.Equal(t, kubevirtv1.DiskBusSCSI, options.Disk.Disk.Bus)
+	require.Equal(t, "test-machine-disk-3-abcde", options.VolumeSource.PersistentVolumeClaim.ClaimName)
+	require.True(t, options.VolumeSource.PersistentVolumeClaim.Hotpluggable)
+}
+
+func TestRemoveHonorsHotplugRetainPolicy(t *testing.T) {
+	vm := testHotplugVM()
+	vm.Namespace = defaultNamespace
+	vm.Annotations = map[string]string{}
+	vm.Spec.Template.Spec.Volumes = append(vm.Spec.Template.Spec.Volumes, kubevirtv1.Volume{
+		Name: "user-volume",
+		VolumeSource: kubevirtv1.VolumeSource{
+			PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
+				PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{ClaimName: "user-volume"},
+				Hotpluggable:                      true,
+			},
+		},
+	})
+	pvc := func(name string, annotations map[string]string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: defaultNamespace, Annotations: annotations},
+		}
+	}
+	hotplugAnnotations := map[string]string{
+		machineNameAnnotationKey:      "test-machine",
+		diskRetainPolicyAnnotationKey: diskRetainPolicyDelete,
+	}
+	d, kubeClient, _ := newFakeDriver(
+		vm,
+		pvc("test-machine-disk-0-abcde", nil),
+		pvc("test-machine-disk-2-fghij", hotplugAnnotations),
+		pvc("user-volume", nil),
+	)
+	d.DiskRetainPolicy = diskRetainPolicyRetain
+
+	// the hotplugged volume is deleted by its own policy, while the volume
+	// hotplugged by the user is left alone
+	hotplugged, err := d.hotpluggedClaims(vm)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"test-machine-disk-2-fghij": diskRetainPolicyDelete}, hotplugged)
+	retained := d.retainedPVCs(vm, hotplugged)
+	require.NotContains(t, retained, "test-machine-disk-2-fghij")
+	patchedVM, err := d.patchRemovedPVCs(vm, hotplugged, retained)
+	require.NoError(t, err)
+	require.Equal(t, "test-machine-disk-2-fghij", patchedVM.Annotations[harvesterutil.RemovedPVCsAnnotationKey])
+
+	// without its own policy, it follows the global one
+	hotplugPVC := pvc("test-machine-disk-2-fghij", map[string]string{machineNameAnnotationKey: "test-machine"})
+	_, err = kubeClient.CoreV1().PersistentVolumeClaims(defaultNamespace).Update(d.ctx, hotplugPVC, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	hotplugged, err = d.hotpluggedClaims(vm)
+	require.NoError(t, err)
+	require.Equal(t, "disk-2", d.retainedPVCs(vm, hotplugged)["test-machine-disk-2-fghij"])
+}
+
+// newHotplugServer serves the addvolume and removevolume subresources of the
+// VMs of harvesterClient, applying them to the VM spec like KubeVirt does.
+func newHotplugServer(t *testing.T, harvesterClient *harvfake.Clientset) *rest.RESTClient {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.URL.Path, "/")
+		namespace, name, action := parts[len(parts)-4], parts[len(parts)-2], parts[len(parts)-1]
+		vms := harvesterClient.KubevirtV1().VirtualMachines(namespace)
+		vm, err := vms.Get(r.Context(), name, metav1.GetOptions{})
+		require.NoError(t, err)
+		spec := &vm.Spec.Template.Spec
+		switch action {
+		case actionAddVolume:
+			var options kubevirtv1.AddVolumeOptions
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&options))
+			spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, *options.Disk)
+			spec.Volumes = append(spec.Volumes, kubevirtv1.Volume{
+				Name:         options.Name,
+				VolumeSource: kubevirtv1.VolumeSource{PersistentVolumeClaim: options.VolumeSource.PersistentVolumeClaim},
+			})
+		case actionRemoveVolume:
+			var options kubevirtv1.RemoveVolumeOptions
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&options))
+			spec.Volumes = slices.DeleteFunc(spec.Volumes, func(volume kubevirtv1.Volume) bool { return volume.Name == options.Name })
+			spec.Domain.Devices.Disks = slices.DeleteFunc(spec.Domain.Devices.Disks, func(disk kubevirtv1.Disk) bool { return disk.Name == options.Name })
+		}
+		_, err = vms.Update(r.Context(), vm, metav1.UpdateOptions{})
+		require.NoError(t, err)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := rest.RESTClientFor(&rest.Config{
+		Host:    server.URL,
+		APIPath: "/apis",
+		ContentConfig: rest.ContentConfig{
+			GroupVersion:         &schema.GroupVersion{Group: kubevirtv1.SubresourceGroupName, Version: kubevirtv1.ApiLatestVersion},
+			NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+		},
+	})
+	require.NoError(t, err)
+	return client
+}
+
+func TestAddVolumeReusingRemovedDiskName(t *testing.T) {
+	vm := testHotplugVM()
+	vm.Namespace = defaultNamespace
+	vm.Spec.Template.Spec.Volumes = vm.Spec.Template.Spec.Volumes[:1]
+	d, _, harvesterClient := newFakeDriver(vm)
+	d.client.KubeVirtSubresourceClient = newHotplugServer(t, harvesterClient)
+	d.DiskInfo = &DiskInfo{Disks: []Disk{{ImageName: "default/image", Size: 10}}}
+
+	diskName, err := d.AddVolume(Disk{StorageClassName: "longhorn", Size: 1, RetainPolicy: diskRetainPolicyRetain})
+	require.NoError(t, err)
+	require.Equal(t, "disk-1", diskName)
+	require.Len(t, d.DiskInfo.Disks, 2)
+	require.Equal(t, diskRetainPolicyRetain, d.DiskInfo.Disks[1].RetainPolicy)
+
+	require.NoError(t, d.RemoveVolume("disk-1"))
+	require.Len(t, d.DiskInfo.Disks, 1)
+
+	// the new disk reuses the name, but not the retain policy of the removed
+	// one
+	diskName, err = d.AddVolume(Disk{StorageClassName: "longhorn", Size: 1})
+	require.NoError(t, err)
+	require.Equal(t, "disk-1", diskName)
+	require.Len(t, d.DiskInfo.Disks, 2)
+	require.Empty(t, d.DiskInfo.Disks[1].RetainPolicy)
+	vm, err = d.getVM()
+	require.NoError(t, err)
+	hotplugged, err := d.hotpluggedClaims(vm)
+	require.NoError(t, err)
+	require.Len(t, hotplugged, 1)
+	for claimName, policy := range hotplugged {
+		require.Equal(t, diskRetainPolicyDelete, policy)
+		pvc, err := d.getPVC(claimName)
+		require.NoError(t, err)
+		require.Equal(t, diskRetainPolicyDelete, pvc.Annotations[diskRetainPolicyAnnotationKey])
+	}
+}
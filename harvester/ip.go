@@ -0,0 +1,254 @@
+package harvester
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/rancher/machine/libmachine/log"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const (
+	ipFamilyIPv4 = "ipv4"
+	ipFamilyIPv6 = "ipv6"
+
+	// networkRouteAnnotationKey records the subnet and gateway of Harvester
+	// VLAN networks
+	networkRouteAnnotationKey = "network.harvesterhci.io/route"
+
+	dockerPort = "2376"
+)
+
+// containerInterfacePrefixes are the name prefixes of the guest interfaces
+// created by Docker, RKE2 and the CNIs they ship with.
+var containerInterfacePrefixes = []string{
+	"docker", "br-", "veth", "cni", "flannel", "cali", "vxlan", "tunl", "cilium", "lxc", "kube-ipvs", "nodelocaldns",
+}
+
+// managementInterfaceName returns the name of the VM interface marked as the
+// management interface in the network info, or an empty string.
+func (d *Driver) managementInterfaceName() string {
+	if d.NetworkInfo == nil {
+		return ""
+	}
+	for i, networkInterface := range d.NetworkInfo.NetworkInterfaces {
+		if networkInterface.Management {
+			return fmt.Sprintf("%s-%d", interfaceNamePrefix, i)
+		}
+	}
+	return ""
+}
+
+// managementInterface returns the name and the status of the interface of
+// vmi with the given name, or of the first interface of its spec if name is
+// empty. The status is matched by interface name, or by MAC address for
+// interfaces which are only reported by the guest agent, since the order of
+// the reported interfaces is not the order of the spec. The interfaces of
+// containers running in the guest are never matched.
+func managementInterface(vmi *kubevirtv1.VirtualMachineInstance, name string) (string, *kubevirtv1.VirtualMachineInstanceNetworkInterface, error) {
+	var spec *kubevirtv1.Interface
+	for i, iface := range vmi.Spec.Domain.Devices.Interfaces {
+		if iface.Name == name || (name == "" && i == 0) {
+			spec = &vmi.Spec.Domain.Devices.Interfaces[i]
+			break
+		}
+	}
+	statuses := vmi.Status.Interfaces
+	if spec == nil {
+		if name != "" {
+			return "", nil, fmt.Errorf("management interface %s not found in machine %s", name, vmi.Name)
+		}
+		for i := range statuses {
+			if !isContainerInterface(statuses[i].InterfaceName) {
+				return statuses[i].Name, &statuses[i], nil
+			}
+		}
+		return "", nil, fmt.Errorf("machine %s has no network interface reported yet", vmi.Name)
+	}
+
+	for i := range statuses {
+		if statuses[i].Name == spec.Name {
+			return spec.Name, &statuses[i], nil
+		}
+	}
+	if spec.MacAddress != "" {
+		for i := range statuses {
+			if sameMAC(statuses[i].MAC, spec.MacAddress) && !isContainerInterface(statuses[i].InterfaceName) {
+				return spec.Name, &statuses[i], nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("interface %s of machine %s has not been reported yet", spec.Name, vmi.Name)
+}
+
+// isContainerInterface reports whether the guest interface with the given
+// name is the loopback or belongs to the container runtime or the CNI of
+// Kubernetes running in the guest, rather than to a NIC attached by Create.
+func isContainerInterface(guestName string) bool {
+	if guestName == "lo" {
+		return true
+	}
+	for _, prefix := range containerInterfacePrefixes {
+		if strings.HasPrefix(guestName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameMAC reports whether the MAC addresses a and b are equal, regardless of
+// their notation.
+func sameMAC(a, b string) bool {
+	macA, errA := net.ParseMAC(a)
+	macB, errB := net.ParseMAC(b)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(a, b)
+	}
+	return bytes.Equal(macA, macB)
+}
+
+// interfaceAddresses returns the addresses reported for iface, without their
+// prefix length. KubeVirt reports the primary address in IP and all of them,
+// one per family on dual-stack networks, in IPs.
+func interfaceAddresses(iface kubevirtv1.VirtualMachineInstanceNetworkInterface) ([]netip.Addr, error) {
+	reported := make([]string, 0, len(iface.IPs)+1)
+	if iface.IP != "" {
+		reported = append(reported, iface.IP)
+	}
+	reported = append(reported, iface.IPs...)
+
+	addresses := make([]netip.Addr, 0, len(reported))
+	seen := make(map[netip.Addr]bool, len(reported))
+	for _, value := range reported {
+		addrStr, _, _ := strings.Cut(value, "/")
+		addr, err := netip.ParseAddr(addrStr)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid IP address", value)
+		}
+		addr = addr.Unmap()
+		if !seen[addr] {
+			seen[addr] = true
+			addresses = append(addresses, addr)
+		}
+	}
+	return addresses, nil
+}
+
+// usableAddresses returns the addresses through which the machine can be
+// reached, dropping loopback, link-local and multicast addresses, and the
+// addresses outside the subnets of the network, for the families the
+// subnets are known of.
+func usableAddresses(addresses []netip.Addr, subnets []netip.Prefix) []netip.Addr {
+	usable := make([]netip.Addr, 0, len(addresses))
+	for _, addr := range addresses {
+		if addr.IsLoopback() || addr.IsUnspecified() || addr.IsLinkLocalUnicast() || addr.IsMulticast() {
+			continue
+		}
+		inSubnet, knownFamily := false, false
+		for _, subnet := range subnets {
+			if subnet.Addr().Is4() != addr.Is4() {
+				continue
+			}
+			knownFamily = true
+			if subnet.Contains(addr) {
+				inSubnet = true
+				break
+			}
+		}
+		if knownFamily && !inSubnet {
+			continue
+		}
+		usable = append(usable, addr)
+	}
+	return usable
+}
+
+// selectAddress returns the recorded address if it is still among
+// addresses, so that the machine address does not change between calls.
+// Otherwise it returns the first address of the preferred family, or the
+// first address of the other family if there is none. An empty family
+// prefers IPv4, like the driver did before IPv6 was supported.
+func selectAddress(addresses []netip.Addr, family, recorded string) (netip.Addr, error) {
+	if len(addresses) == 0 {
+		return netip.Addr{}, errors.New("no usable IP address reported yet")
+	}
+	if addr, err := netip.ParseAddr(recorded); err == nil && slices.Contains(addresses, addr) {
+		return addr, nil
+	}
+	preferIPv6 := family == ipFamilyIPv6
+	for _, addr := range addresses {
+		if addr.Is6() == preferIPv6 {
+			return addr, nil
+		}
+	}
+	return addresses[0], nil
+}
+
+// networkSubnets returns the subnets of the network of the VM interface with
+// the given name, when they are known. Failing to get them only disables
+// the subnet check.
+func (d *Driver) networkSubnets(vmi *kubevirtv1.VirtualMachineInstance, interfaceName string) []netip.Prefix {
+	for _, network := range vmi.Spec.Networks {
+		if network.Name != interfaceName || network.Multus == nil {
+			continue
+		}
+		nad, err := d.getNetwork(network.Multus.NetworkName)
+		if err != nil {
+			log.Debugf("Failed to get network %s of interface %s: %v", network.Multus.NetworkName, interfaceName, err)
+			return nil
+		}
+		return networkAttachmentSubnets(nad)
+	}
+	return nil
+}
+
+// networkAttachmentSubnets returns the subnets of the network attachment
+// definition, from the route Harvester records for VLAN networks and from
+// the IPAM config of the CNI.
+func networkAttachmentSubnets(nad *cniv1.NetworkAttachmentDefinition) []netip.Prefix {
+	var cidrs []string
+	var route struct {
+		CIDR string `json:"cidr"`
+	}
+	if value := nad.Annotations[networkRouteAnnotationKey]; value != "" && json.Unmarshal([]byte(value), &route) == nil {
+		cidrs = append(cidrs, route.CIDR)
+	}
+	var config struct {
+		IPAM struct {
+			Subnet string `json:"subnet"`
+			Range  string `json:"range"`
+			Ranges [][]struct {
+				Subnet string `json:"subnet"`
+			} `json:"ranges"`
+		} `json:"ipam"`
+	}
+	if json.Unmarshal([]byte(nad.Spec.Config), &config) == nil {
+		cidrs = append(cidrs, config.IPAM.Subnet, config.IPAM.Range)
+		for _, rangeSet := range config.IPAM.Ranges {
+			for _, r := range rangeSet {
+				cidrs = append(cidrs, r.Subnet)
+			}
+		}
+	}
+
+	subnets := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if subnet, err := netip.ParsePrefix(cidr); err == nil {
+			subnets = append(subnets, subnet.Masked())
+		}
+	}
+	return subnets
+}
+
+// dockerURL returns the URL of the docker daemon listening on ip, with IPv6
+// addresses enclosed in brackets.
+func dockerURL(ip string) string {
+	return fmt.Sprintf("tcp://%s", net.JoinHostPort(ip, dockerPort))
+}
@@ -0,0 +1,223 @@
+package harvester
+
+import (
+	"net/netip"
+	"testing"
+
+	cniv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func TestManagementInterfaceName(t *testing.T) {
+	d := NewDriver("test-machine", "")
+	require.Empty(t, d.managementInterfaceName())
+	d.NetworkInfo = &NetworkInfo{NetworkInterfaces: []NetworkInterface{
+		{NetworkName: "default/vlan1"},
+		{NetworkName: "default/mgmt", Management: true},
+	}}
+	require.Equal(t, "nic-1", d.managementInterfaceName())
+}
+
+func TestManagementInterface(t *testing.T) {
+	vmi := &kubevirtv1.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-machine"},
+		Spec: kubevirtv1.VirtualMachineInstanceSpec{
+			Domain: kubevirtv1.DomainSpec{
+				Devices: kubevirtv1.Devices{
+					Interfaces: []kubevirtv1.Interface{
+						{Name: "nic-0", MacAddress: "52:54:00:00:00:01"},
+						{Name: "nic-1", MacAddress: "52:54:00:00:00:02"},
+						{Name: "nic-2", MacAddress: "52:54:00:00:00:03"},
+					},
+				},
+			},
+		},
+		Status: kubevirtv1.VirtualMachineInstanceStatus{
+			Interfaces: []kubevirtv1.VirtualMachineInstanceNetworkInterface{
+				{Name: "nic-1", IP: "10.0.1.5", MAC: "52:54:00:00:00:02"},
+				{IP: "172.17.0.1", MAC: "52:54:00:00:00:03", InterfaceName: "docker0"},
+				{IP: "10.0.2.5", MAC: "52-54-00-00-00-03", InterfaceName: "enp3s0"},
+				{Name: "nic-0", IP: "10.0.0.5", MAC: "52:54:00:00:00:01"},
+			},
+		},
+	}
+	tests := []struct {
+		name     string
+		target   string
+		wantName string
+		want     string
+		err      string
+	}{
+		{
+			name:     "first interface of the spec",
+			wantName: "nic-0",
+			want:     "10.0.0.5",
+		},
+		{
+			name:     "matched by name",
+			target:   "nic-1",
+			wantName: "nic-1",
+			want:     "10.0.1.5",
+		},
+		{
+			name:     "matched by MAC",
+			target:   "nic-2",
+			wantName: "nic-2",
+			want:     "10.0.2.5",
+		},
+		{
+			name:   "unknown interface",
+			target: "nic-3",
+			err:    "management interface nic-3 not found in machine test-machine",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, iface, err := managementInterface(vmi, tt.target)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantName, name)
+			require.Equal(t, tt.want, iface.IP)
+		})
+	}
+
+	vmi.Status.Interfaces = vmi.Status.Interfaces[:1]
+	_, _, err := managementInterface(vmi, "nic-2")
+	require.EqualError(t, err, "interface nic-2 of machine test-machine has not been reported yet")
+
+	// without interfaces in the spec, the first NIC reported is used
+	vmi.Spec.Domain.Devices.Interfaces = nil
+	vmi.Status.Interfaces = []kubevirtv1.VirtualMachineInstanceNetworkInterface{
+		{IP: "127.0.0.1", InterfaceName: "lo"},
+		{IP: "10.42.0.1", InterfaceName: "cni0"},
+		{IP: "10.0.0.5", InterfaceName: "eth0"},
+	}
+	_, iface, err := managementInterface(vmi, "")
+	require.NoError(t, err)
+	require.Equal(t, "eth0", iface.InterfaceName)
+}
+
+func TestUsableAddresses(t *testing.T) {
+	addresses, err := interfaceAddresses(kubevirtv1.VirtualMachineInstanceNetworkInterface{
+		IPs: []string{"169.254.1.1", "fe80::1%eth0", "127.0.0.1", "192.168.1.5", "10.0.0.5", "fd00::5"},
+	})
+	require.NoError(t, err)
+
+	usable := usableAddresses(addresses, nil)
+	require.Equal(t, []netip.Addr{
+		netip.MustParseAddr("192.168.1.5"), netip.MustParseAddr("10.0.0.5"), netip.MustParseAddr("fd00::5"),
+	}, usable)
+
+	// the IPv6 address is kept since the IPv6 subnet is not known
+	usable = usableAddresses(addresses, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")})
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.5"), netip.MustParseAddr("fd00::5")}, usable)
+}
+
+func TestNetworkAttachmentSubnets(t *testing.T) {
+	nad := &cniv1.NetworkAttachmentDefinition{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				networkRouteAnnotationKey: `{"mode":"auto","cidr":"172.16.0.0/24","gateway":"172.16.0.1"}`,
+			},
+		},
+		Spec: cniv1.NetworkAttachmentDefinitionSpec{
+			Config: `{"cniVersion":"0.3.1","type":"bridge","ipam":{"type":"host-local","ranges":[[{"subnet":"fd00::/64"}]]}}`,
+		},
+	}
+	require.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("172.16.0.0/24"), netip.MustParsePrefix("fd00::/64"),
+	}, networkAttachmentSubnets(nad))
+
+	nad.Annotations = nil
+	nad.Spec.Config = `{"cniVersion":"0.3.1","type":"bridge","bridge":"mgmt-br","vlan":1,"ipam":{}}`
+	require.Empty(t, networkAttachmentSubnets(nad))
+}
+
+func TestInterfaceAddresses(t *testing.T) {
+	addresses, err := interfaceAddresses(kubevirtv1.VirtualMachineInstanceNetworkInterface{
+		IP:  "10.0.0.5/24",
+		IPs: []string{"10.0.0.5/24", "fd00::5/64", "::ffff:10.0.0.6"},
+	})
+	require.NoError(t, err)
+	require.Len(t, addresses, 3)
+	require.Equal(t, "10.0.0.5", addresses[0].String())
+	require.Equal(t, "fd00::5", addresses[1].String())
+	require.Equal(t, "10.0.0.6", addresses[2].String())
+
+	_, err = interfaceAddresses(kubevirtv1.VirtualMachineInstanceNetworkInterface{IP: "invalid"})
+	require.EqualError(t, err, "invalid is not a valid IP address")
+}
+
+func TestSelectAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		ips      []string
+		family   string
+		recorded string
+		want     string
+		err      string
+	}{
+		{
+			name: "ipv4 by default",
+			ips:  []string{"fd00::5", "10.0.0.5"},
+			want: "10.0.0.5",
+		},
+		{
+			name:   "preferred ipv6",
+			ips:    []string{"10.0.0.5", "fd00::5"},
+			family: ipFamilyIPv6,
+			want:   "fd00::5",
+		},
+		{
+			name:   "ipv6 only",
+			ips:    []string{"fd00::5"},
+			family: ipFamilyIPv4,
+			want:   "fd00::5",
+		},
+		{
+			name:   "ipv4 only",
+			ips:    []string{"10.0.0.5"},
+			family: ipFamilyIPv6,
+			want:   "10.0.0.5",
+		},
+		{
+			name:     "recorded address",
+			ips:      []string{"10.0.0.5", "10.0.0.6"},
+			recorded: "10.0.0.6",
+			want:     "10.0.0.6",
+		},
+		{
+			name:     "recorded address is gone",
+			ips:      []string{"10.0.0.5"},
+			recorded: "10.0.0.6",
+			want:     "10.0.0.5",
+		},
+		{
+			name: "no address",
+			err:  "no usable IP address reported yet",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addresses, err := interfaceAddresses(kubevirtv1.VirtualMachineInstanceNetworkInterface{IPs: tt.ips})
+			require.NoError(t, err)
+			addr, err := selectAddress(addresses, tt.family, tt.recorded)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, addr.String())
+		})
+	}
+}
+
+func TestDockerURL(t *testing.T) {
+	require.Equal(t, "tcp://10.0.0.5:2376", dockerURL("10.0.0.5"))
+	require.Equal(t, "tcp://[fd00::5]:2376", dockerURL("fd00::5"))
+}
@@ -0,0 +1,133 @@
+package harvester
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rancher/machine/libmachine/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const migrationAbortTimeout = 30 * time.Second
+
+// Migrate live migrates the machine to another Harvester host without
+// stopping it. If nodeSelector is not empty, the target host must match it in
+// addition to the affinity of the machine. It is run by the migrate command.
+func (d *Driver) Migrate(nodeSelector map[string]string) error {
+	return d.withTimeout(operationMigrate, d.MigrateTimeout, func() error {
+		return d.migrate(nodeSelector)
+	})
+}
+
+func (d *Driver) migrate(nodeSelector map[string]string) error {
+	log.Debugf("Migrate node")
+	vmi, err := d.getVMI()
+	if err != nil {
+		return err
+	}
+	if vmi.Status.Phase != kubevirtv1.Running {
+		return fmt.Errorf("machine %s is not running, current phase is %s", d.MachineName, vmi.Status.Phase)
+	}
+	for _, condition := range vmi.Status.Conditions {
+		if condition.Type == kubevirtv1.VirtualMachineInstanceIsMigratable && condition.Status == corev1.ConditionFalse {
+			return fmt.Errorf("machine %s is not live migratable: %s", d.MachineName, condition.Message)
+		}
+	}
+
+	migration, err := d.createMigration(&kubevirtv1.VirtualMachineInstanceMigration{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: d.MachineName + "-",
+			Namespace:    d.VMNamespace,
+		},
+		Spec: kubevirtv1.VirtualMachineInstanceMigrationSpec{
+			VMIName:           d.MachineName,
+			AddedNodeSelector: nodeSelector,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Migrating machine %s from node %s", d.MachineName, vmi.Status.NodeName)
+
+	if err = d.waitForMigration(migration.Name); err != nil {
+		if d.ctx.Err() != nil {
+			d.abortMigration(migration.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *Driver) waitForMigration(migrationName string) error {
+	var (
+		lastPhase    kubevirtv1.VirtualMachineInstanceMigrationPhase
+		migrationErr error
+	)
+	completed := func() (bool, error) {
+		migration, err := d.getMigration(migrationName)
+		if err != nil {
+			return false, err
+		}
+		if phase := migration.Status.Phase; phase != lastPhase {
+			log.Infof("Migration %s of machine %s is %s", migrationName, d.MachineName, phase)
+			lastPhase = phase
+		}
+		switch migration.Status.Phase {
+		case kubevirtv1.MigrationSucceeded:
+			if state := migration.Status.MigrationState; state != nil {
+				log.Infof("Machine %s migrated to node %s", d.MachineName, state.TargetNode)
+			}
+			return true, nil
+		case kubevirtv1.MigrationFailed:
+			migrationErr = fmt.Errorf("migration %s of machine %s failed: %s", migrationName, d.MachineName, getMigrationFailureReason(migration))
+			return true, nil
+		}
+		return false, nil
+	}
+	c, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	// the migration is watched as well, since a migration which fails
+	// before it starts does not change the VMI
+	log.Debugf("Waiting for node migrated")
+	if err = d.waitForTargets("machine migrated", completed, []watchTarget{
+		{kind: "vmi", name: d.MachineName, watchFn: c.HarvesterClient.KubevirtV1().VirtualMachineInstances(d.VMNamespace).Watch},
+		{kind: "migration", name: migrationName, watchFn: c.HarvesterClient.KubevirtV1().VirtualMachineInstanceMigrations(d.VMNamespace).Watch},
+	}); err != nil {
+		return err
+	}
+	return migrationErr
+}
+
+// abortMigration deletes an unfinished migration, which makes KubeVirt cancel
+// it.
+func (d *Driver) abortMigration(migrationName string) {
+	log.Warnf("Aborting migration %s of machine %s", migrationName, d.MachineName)
+	d.withDetachedContext(migrationAbortTimeout, func() {
+		if err := d.deleteMigration(migrationName); err != nil {
+			log.Warnf("Failed to abort migration %s: %v", migrationName, err)
+		}
+	})
+}
+
+func getMigrationFailureReason(migration *kubevirtv1.VirtualMachineInstanceMigration) string {
+	if state := migration.Status.MigrationState; state != nil && state.FailureReason != "" {
+		return state.FailureReason
+	}
+	var reasons []string
+	for _, condition := range migration.Status.Conditions {
+		if condition.Message != "" {
+			reasons = append(reasons, condition.Message)
+		} else if condition.Reason != "" {
+			reasons = append(reasons, condition.Reason)
+		}
+	}
+	if len(reasons) == 0 {
+		return "unknown reason"
+	}
+	return strings.Join(reasons, "; ")
+}
@@ -0,0 +1,53 @@
+package harvester
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func TestGetMigrationFailureReason(t *testing.T) {
+	migration := &kubevirtv1.VirtualMachineInstanceMigration{}
+	require.Equal(t, "unknown reason", getMigrationFailureReason(migration))
+
+	migration.Status.Conditions = []kubevirtv1.VirtualMachineInstanceMigrationCondition{
+		{Reason: "MigrationRejectedByResourceQuota"},
+		{Message: "target pod could not be scheduled"},
+	}
+	require.Equal(t, "MigrationRejectedByResourceQuota; target pod could not be scheduled", getMigrationFailureReason(migration))
+
+	migration.Status.MigrationState = &kubevirtv1.VirtualMachineInstanceMigrationState{
+		FailureReason: "Live migration failed: connection refused",
+	}
+	require.Equal(t, "Live migration failed: connection refused", getMigrationFailureReason(migration))
+}
+
+func TestWaitForMigrationFails(t *testing.T) {
+	migration := &kubevirtv1.VirtualMachineInstanceMigration{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-machine-abcde", Namespace: defaultNamespace},
+		Status:     kubevirtv1.VirtualMachineInstanceMigrationStatus{Phase: kubevirtv1.MigrationPending},
+	}
+	d, _, harvesterClient := newFakeDriver(migration)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	d.ctx = ctx
+
+	// the failure must be noticed from the migration watch, long before the
+	// wait resyncs
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		failed := migration.DeepCopy()
+		failed.Status.Phase = kubevirtv1.MigrationFailed
+		failed.Status.MigrationState = &kubevirtv1.VirtualMachineInstanceMigrationState{FailureReason: "target pod could not be scheduled"}
+		_, err := harvesterClient.KubevirtV1().VirtualMachineInstanceMigrations(defaultNamespace).Update(context.Background(), failed, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+	}()
+	err := d.waitForMigration(migration.Name)
+	require.EqualError(t, err, "migration test-machine-abcde of machine test-machine failed: target pod could not be scheduled")
+	require.NoError(t, ctx.Err())
+}
@@ -0,0 +1,440 @@
+package harvester
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/utils/ptr"
+)
+
+// networkDataDocument is a cloud-init network config, whose sections are
+// either under the network key or at the root of the document.
+type networkDataDocument struct {
+	Network *networkData `json:"network"`
+	networkData
+}
+
+type networkData struct {
+	Version *int `json:"version"`
+
+	// version 1
+	Config []networkDataV1Config `json:"config"`
+
+	// version 2
+	Ethernets map[string]*netplanDevice `json:"ethernets"`
+	Bonds     map[string]*netplanDevice `json:"bonds"`
+	Bridges   map[string]*netplanDevice `json:"bridges"`
+	VLANs     map[string]*netplanDevice `json:"vlans"`
+}
+
+type networkDataV1Config struct {
+	Type    string                `json:"type"`
+	Subnets []networkDataV1Subnet `json:"subnets"`
+	// Address lists the addresses of a nameserver config
+	Address []string `json:"address"`
+}
+
+type networkDataV1Subnet struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+	Gateway string `json:"gateway"`
+}
+
+type netplanDevice struct {
+	DHCP4 *bool `json:"dhcp4"`
+	DHCP6 *bool `json:"dhcp6"`
+	// Addresses are either addresses or mappings from an address to its
+	// options
+	Addresses   []json.RawMessage   `json:"addresses"`
+	Gateway4    *string             `json:"gateway4"`
+	Gateway6    *string             `json:"gateway6"`
+	Routes      []netplanRoute      `json:"routes"`
+	Nameservers *netplanNameservers `json:"nameservers"`
+
+	// bonds and bridges
+	Interfaces []string `json:"interfaces"`
+
+	// vlans
+	ID   *int   `json:"id"`
+	Link string `json:"link"`
+}
+
+type netplanRoute struct {
+	To  string `json:"to"`
+	Via string `json:"via"`
+}
+
+type netplanNameservers struct {
+	Addresses []string `json:"addresses"`
+}
+
+// netplanDeviceTypes are the device sections of network config version 2
+// which are validated. Device IDs are unique across all of them.
+var netplanDeviceTypes = []string{"ethernets", "bonds", "bridges", "vlans"}
+
+// netplanMemberTypes are the device types which can be members of bonds and
+// bridges.
+var netplanMemberTypes = map[string][]string{
+	"bonds":   {"ethernets"},
+	"bridges": {"ethernets", "bonds", "vlans"},
+}
+
+// netplanCounts are the default gateways, DHCP clients and nameservers
+// configured by network config version 2 devices.
+type netplanCounts struct {
+	defaultGateway4, defaultGateway6 int
+	dhcp, nameServer                 int
+}
+
+func checkNetworkData(networkDataStr string) error {
+	if networkDataStr == "" {
+		return nil
+	}
+
+	network, err := parseNetworkData(networkDataStr)
+	if err != nil {
+		return err
+	}
+
+	switch *network.Version {
+	case 1:
+		return checkNetworkDataV1(network)
+	case 2:
+		return checkNetworkDataV2(network)
+	default:
+		return fmt.Errorf("network.version must be 1 or 2, but get: %d", *network.Version)
+	}
+}
+
+// parseNetworkData parses the network config of cloud-init. Sections of the
+// wrong type are reported with their path in the document.
+func parseNetworkData(networkDataStr string) (*networkData, error) {
+	data, err := yaml.YAMLToJSON([]byte(networkDataStr))
+	if err != nil {
+		return nil, fmt.Errorf("invalid network data: %w", err)
+	}
+	var document networkDataDocument
+	if err = json.Unmarshal(data, &document); err != nil {
+		return nil, networkDataDecodeError(err)
+	}
+	network := &document.networkData
+	if document.Network != nil {
+		network = document.Network
+	}
+	if network.Version == nil {
+		return nil, errors.New("network.version is missing")
+	}
+	return network, nil
+}
+
+// networkDataDecodeError converts the error decoding the network config to
+// an error giving the path of the section in the document.
+func networkDataDecodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		return fmt.Errorf("invalid network data: %w", err)
+	}
+	if typeErr.Field == "" {
+		return fmt.Errorf("network data must be %s, but get: %s", describeNetworkDataType(typeErr.Type), typeErr.Value)
+	}
+	return fmt.Errorf("%s must be %s, but get: %s", networkDataPath(typeErr.Field), describeNetworkDataType(typeErr.Type), typeErr.Value)
+}
+
+// networkDataPath converts the dotted path of a decoded field, such as
+// config.0.type, to the path of the section in the network config, such as
+// network.config[0].type.
+func networkDataPath(field string) string {
+	segments := strings.Split(field, ".")
+	var path strings.Builder
+	if segments[0] != "network" {
+		path.WriteString("network")
+	}
+	for i, segment := range segments {
+		if _, err := strconv.Atoi(segment); err == nil && i > 0 {
+			fmt.Fprintf(&path, "[%s]", segment)
+			continue
+		}
+		if path.Len() > 0 {
+			path.WriteByte('.')
+		}
+		path.WriteString(segment)
+	}
+	return path.String()
+}
+
+func describeNetworkDataType(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "an integer"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	case reflect.Map, reflect.Struct:
+		return "a mapping"
+	default:
+		return t.String()
+	}
+}
+
+func checkNetworkDataV1(network *networkData) error {
+	var defaultGatewayCount, nameServerCount, dhcpAllCount int
+
+	if network.Config == nil {
+		return errors.New("network.config is missing")
+	}
+	for i, config := range network.Config {
+		path := fmt.Sprintf("network.config[%d]", i)
+		switch config.Type {
+		case "":
+			return fmt.Errorf("%s.type is missing", path)
+		case "physical":
+			gatewayCount, dhcpCount, err := getGatewayAndDHCPCount(path, config)
+			if err != nil {
+				return err
+			}
+			defaultGatewayCount += gatewayCount
+			nameServerCount += dhcpCount
+			dhcpAllCount += dhcpCount
+		case "nameserver":
+			if config.Address == nil {
+				return fmt.Errorf("%s.address is missing", path)
+			}
+			nameServerCount += len(config.Address)
+		}
+	}
+
+	if defaultGatewayCount > 1 {
+		return fmt.Errorf("the number of default gateway cannot greater than 1, but get: %d", defaultGatewayCount)
+	}
+
+	if defaultGatewayCount == 0 && dhcpAllCount == 0 {
+		return errors.New("static gateway or dhcp is not configured")
+	}
+
+	if nameServerCount == 0 {
+		return errors.New("nameserver is not configured")
+	}
+
+	return nil
+}
+
+func getGatewayAndDHCPCount(path string, config networkDataV1Config) (int, int, error) {
+	var gatewayCount, dhcpCount int
+
+	if config.Subnets == nil {
+		return 0, 0, fmt.Errorf("%s.subnets is missing", path)
+	}
+	for i, subnet := range config.Subnets {
+		switch subnet.Type {
+		case "":
+			return 0, 0, fmt.Errorf("%s.subnets[%d].type is missing", path, i)
+		case "dhcp":
+			// dhcp not always generate a default route
+			// gatewayCount += 1
+			dhcpCount += 1
+		case "static":
+			if subnet.Gateway != "" {
+				gatewayCount += 1
+			}
+		}
+	}
+	return gatewayCount, dhcpCount, nil
+}
+
+func checkNetworkDataV2(network *networkData) error {
+	deviceTypes := make(map[string]string)
+	devices := make(map[string]*netplanDevice)
+	for _, deviceType := range netplanDeviceTypes {
+		for id, device := range network.netplanDevices(deviceType) {
+			if otherType, ok := deviceTypes[id]; ok {
+				return fmt.Errorf("network.%s.%s: device ID is already used in network.%s", deviceType, id, otherType)
+			}
+			if device == nil {
+				device = &netplanDevice{}
+			}
+			deviceTypes[id] = deviceType
+			devices[id] = device
+		}
+	}
+	if len(devices) == 0 {
+		return errors.New("no ethernets, bonds, bridges or vlans are configured")
+	}
+
+	ids := make([]string, 0, len(devices))
+	for id := range devices {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	var counts netplanCounts
+	for _, id := range ids {
+		path := fmt.Sprintf("network.%s.%s", deviceTypes[id], id)
+		if err := checkNetplanDevice(path, deviceTypes[id], devices[id], deviceTypes, &counts); err != nil {
+			return err
+		}
+	}
+
+	if counts.defaultGateway4 > 1 {
+		return fmt.Errorf("the number of IPv4 default gateway cannot greater than 1, but get: %d", counts.defaultGateway4)
+	}
+	if counts.defaultGateway6 > 1 {
+		return fmt.Errorf("the number of IPv6 default gateway cannot greater than 1, but get: %d", counts.defaultGateway6)
+	}
+	if counts.defaultGateway4+counts.defaultGateway6 == 0 && counts.dhcp == 0 {
+		return errors.New("static gateway or dhcp is not configured")
+	}
+	if counts.nameServer == 0 && counts.dhcp == 0 {
+		return errors.New("nameserver is not configured")
+	}
+	return nil
+}
+
+func (n *networkData) netplanDevices(deviceType string) map[string]*netplanDevice {
+	switch deviceType {
+	case "ethernets":
+		return n.Ethernets
+	case "bonds":
+		return n.Bonds
+	case "bridges":
+		return n.Bridges
+	case "vlans":
+		return n.VLANs
+	default:
+		return nil
+	}
+}
+
+// checkNetplanDevice validates the network config version 2 device at path
+// and adds its gateways, DHCP clients and nameservers to counts.
+func checkNetplanDevice(path, deviceType string, device *netplanDevice, deviceTypes map[string]string, counts *netplanCounts) error {
+	if ptr.Deref(device.DHCP4, false) {
+		counts.dhcp++
+	}
+	if ptr.Deref(device.DHCP6, false) {
+		counts.dhcp++
+	}
+
+	for i, address := range device.Addresses {
+		if err := checkNetplanAddress(address); err != nil {
+			return fmt.Errorf("%s.addresses[%d]: %w", path, i, err)
+		}
+	}
+
+	// gateway4 and gateway6 are deprecated in favor of default routes
+	if device.Gateway4 != nil {
+		if gateway, err := netip.ParseAddr(*device.Gateway4); err != nil || !gateway.Is4() {
+			return fmt.Errorf("%s.gateway4: invalid gateway %s", path, *device.Gateway4)
+		}
+		counts.defaultGateway4++
+	}
+	if device.Gateway6 != nil {
+		if gateway, err := netip.ParseAddr(*device.Gateway6); err != nil || !gateway.Is6() {
+			return fmt.Errorf("%s.gateway6: invalid gateway %s", path, *device.Gateway6)
+		}
+		counts.defaultGateway6++
+	}
+
+	for i, route := range device.Routes {
+		if err := checkNetplanRoute(fmt.Sprintf("%s.routes[%d]", path, i), route, counts); err != nil {
+			return err
+		}
+	}
+
+	if device.Nameservers != nil {
+		for i, address := range device.Nameservers.Addresses {
+			if _, err := netip.ParseAddr(address); err != nil {
+				return fmt.Errorf("%s.nameservers.addresses[%d]: invalid address %s", path, i, address)
+			}
+		}
+		counts.nameServer += len(device.Nameservers.Addresses)
+	}
+
+	switch deviceType {
+	case "bonds", "bridges":
+		for i, member := range device.Interfaces {
+			if !slices.Contains(netplanMemberTypes[deviceType], deviceTypes[member]) {
+				return fmt.Errorf("%s.interfaces[%d]: %s is not one of the %s", path, i, member, strings.Join(netplanMemberTypes[deviceType], ", "))
+			}
+		}
+	case "vlans":
+		if device.ID == nil || *device.ID < 0 || *device.ID > 4094 {
+			return fmt.Errorf("%s.id must be a VLAN ID between 0 and 4094", path)
+		}
+		if _, ok := deviceTypes[device.Link]; !ok || device.Link == "" {
+			return fmt.Errorf("%s.link must be the ID of a configured device", path)
+		}
+	}
+	return nil
+}
+
+// checkNetplanAddress checks that address is an address with a prefix
+// length, or a mapping from such an address to its options.
+func checkNetplanAddress(address json.RawMessage) error {
+	var addressStr string
+	if err := json.Unmarshal(address, &addressStr); err != nil {
+		var options map[string]json.RawMessage
+		if err = json.Unmarshal(address, &options); err != nil || len(options) != 1 {
+			return errors.New("must be an address or a mapping from an address to its options")
+		}
+		for key := range options {
+			addressStr = key
+		}
+	}
+	if _, err := netip.ParsePrefix(addressStr); err != nil {
+		return fmt.Errorf("invalid address %q, it must have a prefix length", addressStr)
+	}
+	return nil
+}
+
+// checkNetplanRoute validates the network config version 2 route at path and
+// counts it as a default gateway if it is a default route.
+func checkNetplanRoute(path string, route netplanRoute, counts *netplanCounts) error {
+	if route.To == "" {
+		return fmt.Errorf("%s.to is missing", path)
+	}
+	var via netip.Addr
+	if route.Via != "" {
+		var err error
+		if via, err = netip.ParseAddr(route.Via); err != nil {
+			return fmt.Errorf("%s.via: invalid address %s", path, route.Via)
+		}
+	}
+	var to netip.Prefix
+	if route.To == "default" {
+		if !via.IsValid() {
+			return fmt.Errorf("%s.via is required for a default route", path)
+		}
+		to = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+		if via.Is4() {
+			to = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		}
+	} else {
+		var err error
+		if to, err = netip.ParsePrefix(route.To); err != nil {
+			return fmt.Errorf("%s.to: invalid destination %q", path, route.To)
+		}
+	}
+	if via.IsValid() && via.Is4() != to.Addr().Is4() {
+		return fmt.Errorf("%s: gateway %s and destination %s are of different IP families", path, via, to)
+	}
+	if to.Bits() == 0 {
+		if to.Addr().Is4() {
+			counts.defaultGateway4++
+		} else {
+			counts.defaultGateway6++
+		}
+	}
+	return nil
+}
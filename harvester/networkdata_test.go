@@ -0,0 +1,557 @@
+package harvester
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckNetworkData(t *testing.T) {
+	type args struct {
+		networkDataStr string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			args: args{
+				networkDataStr: "",
+			},
+			wantErr: false,
+		},
+		{
+			name: "without network section key",
+			args: args{
+				networkDataStr: `
+version: 1
+config:
+- type: physical
+  name: enp1s0
+  subnets:
+  - type: dhcp
+`,
+			},
+			wantErr: false,
+		},
+		{
+			name: "1 dhcp",
+			args: args{
+				networkDataStr: `
+network:
+  version: 1
+  config:
+   - type: physical
+     name: enp1s0
+     subnets:
+     - type: dhcp
+`,
+			},
+			wantErr: false,
+		},
+		{
+			name: "1 static",
+			args: args{
+				networkDataStr: `
+network:
+  version: 1
+  config:
+   - type: physical
+     name: enp1s0
+     subnets:
+     - type: static
+       address: 192.168.5.91/24
+       gateway: 192.168.5.1
+   - type: nameserver
+     interface: enp1s0
+     address:
+        - 192.168.5.1
+`,
+			},
+			wantErr: false,
+		},
+		{
+			name: "1 static without gateway",
+			args: args{
+				networkDataStr: `
+network:
+  version: 1
+  config:
+   - type: physical
+     name: enp1s0
+     subnets:
+     - type: static
+       address: 192.168.5.91/24
+   - type: nameserver
+     interface: enp1s0
+     address:
+        - 192.168.5.1
+`,
+			},
+			wantErr: true,
+		},
+		{
+			name: "1 static without nameserver",
+			args: args{
+				networkDataStr: `
+network:
+  version: 1
+  config:
+   - type: physical
+     name: enp1s0
+     subnets:
+     - type: static
+       address: 192.168.5.91/24
+       gateway: 192.168.5.1
+`,
+			},
+			wantErr: true,
+		},
+		{
+			name: "2 dhcp",
+			args: args{
+				networkDataStr: `
+network:
+  version: 1
+  config:
+   - type: physical
+     name: enp1s0
+     subnets:
+     - type: dhcp
+   - type: physical
+     name: enp2s0
+     subnets:
+     - type: dhcp
+`,
+			},
+			wantErr: false,
+		},
+		{
+			name: "1 dhcp and 1 static with gateway",
+			args: args{
+				networkDataStr: `
+network:
+  version: 1
+  config:
+   - type: physical
+     name: enp1s0
+     subnets:
+     - type: dhcp
+   - type: physical
+     name: enp2s0
+     subnets:
+     - type: static
+       address: 192.168.5.91/24
+       gateway: 192.168.5.1
+`,
+			},
+			wantErr: false,
+		},
+		{
+			name: "1 dhcp and 1 static without gateway",
+			args: args{
+				networkDataStr: `
+network:
+  version: 1
+  config:
+   - type: physical
+     name: enp1s0
+     subnets:
+     - type: dhcp
+   - type: physical
+     name: enp2s0
+     subnets:
+     - type: static
+       address: 192.168.5.91/24
+`,
+			},
+			wantErr: false,
+		},
+		{
+			name: "2 static with gateway",
+			args: args{
+				networkDataStr: `
+network:
+  version: 1
+  config:
+   - type: physical
+     name: enp1s0
+     subnets:
+     - type: static
+       address: 192.168.5.91/24
+       gateway: 192.168.5.1
+   - type: physical
+     name: enp2s0
+     subnets:
+     - type: static
+       address: 192.168.5.92/24
+       gateway: 192.168.5.1
+`,
+			},
+			wantErr: true,
+		},
+		{
+			name: "2 static without gateway",
+			args: args{
+				networkDataStr: `
+network:
+  version: 1
+  config:
+   - type: physical
+     name: enp1s0
+     subnets:
+     - type: static
+       address: 192.168.5.91/24
+   - type: physical
+     name: enp2s0
+     subnets:
+     - type: static
+       address: 192.168.5.91/24
+   - type: nameserver
+     interface: enp1s0
+     address:
+        - 192.168.5.1
+`,
+			},
+			wantErr: true,
+		},
+		{
+			name: "1 static with gateway and 1 static without gateway",
+			args: args{
+				networkDataStr: `
+network:
+  version: 1
+  config:
+   - type: physical
+     name: enp1s0
+     subnets:
+     - type: static
+       address: 192.168.5.91/24
+       gateway: 192.168.5.1
+   - type: physical
+     name: enp2s0
+     subnets:
+     - type: static
+       address: 192.168.5.92/24
+   - type: nameserver
+     interface: enp1s0
+     address:
+        - 192.168.5.1
+`,
+			},
+			wantErr: false,
+		},
+		{
+			name: "v2 dhcp",
+			args: args{
+				networkDataStr: `
+network:
+  version: 2
+  ethernets:
+    enp1s0:
+      dhcp4: true
+`,
+			},
+			wantErr: false,
+		},
+		{
+			name: "v2 static with default route",
+			args: args{
+				networkDataStr: `
+version: 2
+ethernets:
+  enp1s0:
+    addresses:
+    - 192.168.5.91/24
+    - fd00::91/64
+    routes:
+    - to: default
+      via: 192.168.5.1
+    - to: ::/0
+      via: fd00::1
+    nameservers:
+      addresses: [192.168.5.1]
+`,
+			},
+			wantErr: false,
+		},
+		{
+			name: "v2 static with gateway4",
+			args: args{
+				networkDataStr: `
+network:
+  version: 2
+  ethernets:
+    enp1s0:
+      addresses: [192.168.5.91/24]
+      gateway4: 192.168.5.1
+      nameservers:
+        addresses: [192.168.5.1]
+`,
+			},
+			wantErr: false,
+		},
+		{
+			name: "v2 static without gateway",
+			args: args{
+				networkDataStr: `
+network:
+  version: 2
+  ethernets:
+    enp1s0:
+      addresses: [192.168.5.91/24]
+      nameservers:
+        addresses: [192.168.5.1]
+`,
+			},
+			wantErr: true,
+		},
+		{
+			name: "v2 static without nameserver",
+			args: args{
+				networkDataStr: `
+network:
+  version: 2
+  ethernets:
+    enp1s0:
+      addresses: [192.168.5.91/24]
+      routes:
+      - to: 0.0.0.0/0
+        via: 192.168.5.1
+`,
+			},
+			wantErr: true,
+		},
+		{
+			name: "v2 2 static with gateway",
+			args: args{
+				networkDataStr: `
+network:
+  version: 2
+  ethernets:
+    enp1s0:
+      addresses: [192.168.5.91/24]
+      gateway4: 192.168.5.1
+    enp2s0:
+      addresses: [192.168.6.91/24]
+      routes:
+      - to: default
+        via: 192.168.6.1
+      nameservers:
+        addresses: [192.168.5.1]
+`,
+			},
+			wantErr: true,
+		},
+		{
+			name: "v2 bond and vlan",
+			args: args{
+				networkDataStr: `
+network:
+  version: 2
+  ethernets:
+    enp1s0: {}
+    enp2s0: {}
+  bonds:
+    bond0:
+      interfaces: [enp1s0, enp2s0]
+      parameters:
+        mode: active-backup
+  vlans:
+    vlan100:
+      id: 100
+      link: bond0
+      dhcp4: true
+      dhcp6: false
+  bridges:
+    br0:
+      interfaces: [vlan100]
+`,
+			},
+			wantErr: false,
+		},
+		{
+			name: "v2 no devices",
+			args: args{
+				networkDataStr: `
+network:
+  version: 2
+`,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkNetworkData(tt.args.networkDataStr); (err != nil) != tt.wantErr {
+				t.Errorf("CheckNetworkData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckNetworkDataV2Errors(t *testing.T) {
+	tests := []struct {
+		name        string
+		networkData string
+		err         string
+	}{
+		{
+			name:        "invalid address",
+			networkData: "version: 2\nethernets:\n  enp1s0:\n    dhcp4: true\n    addresses: [192.168.5.91]\n",
+			err:         `network.ethernets.enp1s0.addresses[0]: invalid address "192.168.5.91", it must have a prefix length`,
+		},
+		{
+			name:        "dhcp4 is not a boolean",
+			networkData: "version: 2\nethernets:\n  enp1s0:\n    dhcp4: enabled\n",
+			err:         "network.ethernets.enp1s0.dhcp4 must be a boolean, but get: string",
+		},
+		{
+			name:        "gateway4 of the wrong family",
+			networkData: "version: 2\nethernets:\n  enp1s0:\n    dhcp4: true\n    gateway4: fd00::1\n",
+			err:         "network.ethernets.enp1s0.gateway4: invalid gateway fd00::1",
+		},
+		{
+			name:        "default route without via",
+			networkData: "version: 2\nethernets:\n  enp1s0:\n    dhcp4: true\n    routes:\n    - to: default\n",
+			err:         "network.ethernets.enp1s0.routes[0].via is required for a default route",
+		},
+		{
+			name:        "invalid nameserver",
+			networkData: "version: 2\nethernets:\n  enp1s0:\n    dhcp4: true\n    nameservers:\n      addresses: [dns.example.com]\n",
+			err:         "network.ethernets.enp1s0.nameservers.addresses[0]: invalid address dns.example.com",
+		},
+		{
+			name:        "bond of an unknown interface",
+			networkData: "version: 2\nethernets:\n  enp1s0: {}\nbonds:\n  bond0:\n    dhcp4: true\n    interfaces: [enp1s0, enp2s0]\n",
+			err:         "network.bonds.bond0.interfaces[1]: enp2s0 is not one of the ethernets",
+		},
+		{
+			name:        "vlan without link",
+			networkData: "version: 2\nethernets:\n  enp1s0: {}\nvlans:\n  vlan100:\n    id: 100\n    dhcp4: true\n",
+			err:         "network.vlans.vlan100.link must be the ID of a configured device",
+		},
+		{
+			name:        "vlan ID out of range",
+			networkData: "version: 2\nethernets:\n  enp1s0: {}\nvlans:\n  vlan5000:\n    id: 5000\n    link: enp1s0\n    dhcp4: true\n",
+			err:         "network.vlans.vlan5000.id must be a VLAN ID between 0 and 4094",
+		},
+		{
+			name:        "two IPv4 default gateways",
+			networkData: "version: 2\nethernets:\n  enp1s0:\n    dhcp6: true\n    gateway4: 192.168.5.1\n    routes:\n    - to: 0.0.0.0/0\n      via: 192.168.5.1\n",
+			err:         "the number of IPv4 default gateway cannot greater than 1, but get: 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.EqualError(t, checkNetworkData(tt.networkData), tt.err)
+		})
+	}
+}
+
+func TestParseNetworkDataErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		networkData string
+		err         string
+	}{
+		{
+			name:        "version is a string",
+			networkData: "network:\n  version: \"1\"\n  config: []\n",
+			err:         "network.version must be an integer, but get: string",
+		},
+		{
+			name:        "version without network key is a string",
+			networkData: "version: two\n",
+			err:         "network.version must be an integer, but get: string",
+		},
+		{
+			name:        "version is missing",
+			networkData: "network:\n  config: []\n",
+			err:         "network.version is missing",
+		},
+		{
+			name:        "unsupported version",
+			networkData: "version: 3\n",
+			err:         "network.version must be 1 or 2, but get: 3",
+		},
+		{
+			name:        "document is a list",
+			networkData: "- version: 1\n",
+			err:         "network data must be a mapping, but get: array",
+		},
+		{
+			name:        "network is a string",
+			networkData: "network: v1\n",
+			err:         "network must be a mapping, but get: string",
+		},
+		{
+			name:        "config is a mapping",
+			networkData: "version: 1\nconfig:\n  type: physical\n",
+			err:         "network.config must be a list, but get: object",
+		},
+		{
+			name:        "ethernets is a list",
+			networkData: "version: 2\nethernets:\n- enp1s0\n",
+			err:         "network.ethernets must be a mapping, but get: array",
+		},
+		{
+			name:        "config type is missing",
+			networkData: "version: 1\nconfig:\n- name: enp1s0\n",
+			err:         "network.config[0].type is missing",
+		},
+		{
+			name:        "subnets are missing",
+			networkData: "version: 1\nconfig:\n- type: physical\n  name: enp1s0\n",
+			err:         "network.config[0].subnets is missing",
+		},
+		{
+			name:        "subnet type is missing",
+			networkData: "version: 1\nconfig:\n- type: physical\n  subnets:\n  - address: 192.168.5.91/24\n",
+			err:         "network.config[0].subnets[0].type is missing",
+		},
+		{
+			name:        "nameserver address is missing",
+			networkData: "version: 1\nconfig:\n- type: physical\n  subnets:\n  - type: dhcp\n- type: nameserver\n",
+			err:         "network.config[1].address is missing",
+		},
+		{
+			name:        "invalid yaml",
+			networkData: "version: [1\n",
+			err:         "invalid network data: yaml: line 1: did not find expected ',' or ']'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.EqualError(t, checkNetworkData(tt.networkData), tt.err)
+		})
+	}
+}
+
+func TestNetworkDataPath(t *testing.T) {
+	require.Equal(t, "network.config[0].subnets[1].type", networkDataPath("config.0.subnets.1.type"))
+	require.Equal(t, "network.ethernets.enp1s0.routes[0].to", networkDataPath("network.ethernets.enp1s0.routes.0.to"))
+	require.Equal(t, "network.version", networkDataPath("version"))
+}
+
+func FuzzCheckNetworkData(f *testing.F) {
+	for _, seed := range []string{
+		"version: 1\nconfig:\n- type: physical\n  name: enp1s0\n  subnets:\n  - type: dhcp\n",
+		"network:\n  version: 1\n  config:\n  - type: nameserver\n    address: [192.168.5.1]\n",
+		"network:\n  version: 2\n  ethernets:\n    enp1s0:\n      dhcp4: true\n",
+		"version: 2\nethernets:\n  enp1s0:\n    addresses: [192.168.5.91/24, {fd00::91/64: {label: v6}}]\n    routes:\n    - to: default\n      via: 192.168.5.1\n    nameservers:\n      addresses: [192.168.5.1]\n",
+		"version: 2\nethernets:\n  enp1s0: {}\nbonds:\n  bond0:\n    interfaces: [enp1s0]\nvlans:\n  vlan1:\n    id: 1\n    link: bond0\n    dhcp6: true\n",
+		"version: \"1\"\n",
+		"network: [1, 2]\n",
+		"- 1\n",
+		"~\n",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, networkData string) {
+		// only panics fail, invalid network data is expected
+		_ = checkNetworkData(networkData)
+	})
+}
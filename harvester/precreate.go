@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	harvsterv1 "github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
+	"github.com/rancher/machine/libmachine/log"
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -19,9 +20,13 @@ func (d *Driver) PreCreateCheck() error {
 		return fmt.Errorf("current harvester server version is %s, only support v0.2.0+", d.ServerVersion)
 	}
 
-	// vm already exists
-	if _, err = d.getVM(); err == nil {
-		return fmt.Errorf("machine %s already exists in namespace %s", d.MachineName, d.VMNamespace)
+	// vm already exists, unless it is left over by an interrupted Create of
+	// this machine which Create can resume
+	if vm, err := d.getVM(); err == nil {
+		if !d.isOwnedVM(vm) {
+			return fmt.Errorf("machine %s already exists in namespace %s", d.MachineName, d.VMNamespace)
+		}
+		log.Infof("Machine %s already exists in namespace %s, its creation will be resumed", d.MachineName, d.VMNamespace)
 	}
 
 	// keypair check
@@ -46,6 +51,24 @@ func (d *Driver) PreCreateCheck() error {
 		d.SSHPublicKey = keypair.Spec.PublicKey
 	}
 
+	// template check
+	if d.TemplateName != "" {
+		if _, err = d.resolveTemplateVersion(); err != nil {
+			return err
+		}
+	}
+
+	// restored disks check
+	if d.RestoreFrom != "" {
+		backup, err := d.getRestoreBackup()
+		if err != nil {
+			return err
+		}
+		if _, err = restoredDisks(backup, d.VMNamespace, d.RestoreDataDisks); err != nil {
+			return err
+		}
+	}
+
 	// image and storageClass check
 	if d.DiskInfo != nil {
 		for _, disk := range d.DiskInfo.Disks {
@@ -60,7 +83,7 @@ func (d *Driver) PreCreateCheck() error {
 				}
 			}
 		}
-	} else {
+	} else if d.usesImageFlags() {
 		// Compatible with older versions
 		if _, err = d.getImage(d.ImageName); err != nil {
 			return err
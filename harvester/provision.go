@@ -0,0 +1,142 @@
+package harvester
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/rancher/machine/libmachine/log"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	"github.com/harvester/harvester/pkg/builder"
+)
+
+const (
+	vmCreator = "docker-machine-driver-harvester"
+
+	// machineNameAnnotationKey marks a VM as created by this driver for the
+	// machine with the given name.
+	machineNameAnnotationKey = "harvesterhci.io/machineName"
+	// machineSpecHashAnnotationKey holds the hash of the driver config the VM
+	// was created from, to detect whether a half-finished VM can be resumed.
+	machineSpecHashAnnotationKey = "harvesterhci.io/machineSpecHash"
+	// provisioningPhaseAnnotationKey holds the last phase of Create which
+	// completed for the VM.
+	provisioningPhaseAnnotationKey = "harvesterhci.io/machineProvisioningPhase"
+)
+
+// provisioning checkpoints, in the order Create reaches them
+const (
+	provisioningPhaseNone          = ""
+	provisioningPhaseVMCreated     = "VMCreated"
+	provisioningPhaseSecretCreated = "SecretCreated"
+	provisioningPhaseReady         = "Ready"
+)
+
+var provisioningPhaseOrder = map[string]int{
+	provisioningPhaseNone:          0,
+	provisioningPhaseVMCreated:     1,
+	provisioningPhaseSecretCreated: 2,
+	provisioningPhaseReady:         3,
+}
+
+// provisioningPhaseReached reports whether the VM has completed phase.
+func provisioningPhaseReached(vm *kubevirtv1.VirtualMachine, phase string) bool {
+	current, ok := provisioningPhaseOrder[vm.Annotations[provisioningPhaseAnnotationKey]]
+	return ok && current >= provisioningPhaseOrder[phase]
+}
+
+// isOwnedVM reports whether vm was created by this driver for this machine.
+func (d *Driver) isOwnedVM(vm *kubevirtv1.VirtualMachine) bool {
+	return vm.Labels[builder.LabelKeyVirtualMachineCreator] == vmCreator &&
+		vm.Annotations[machineNameAnnotationKey] == d.MachineName
+}
+
+// specHash returns a hash of the driver config which determines the VM, so a
+// retried Create can verify that an existing VM was created from the same
+// request. Values generated during Create, like PVC names and the SSH key
+// generated for the machine, are not covered. A retried Create generates the
+// PVC names again and restores the saved SSH key.
+func (d *Driver) specHash() (string, error) {
+	spec, err := json.Marshal(struct {
+		CPU                   int
+		CPUModel              string
+		MemorySize            string
+		ReservedMemorySize    string
+		DiskSize              string
+		DiskBus               string
+		ImageName             string
+		DiskInfo              *DiskInfo
+		RestoreFrom           string
+		RestoreDataDisks      bool
+		TemplateName          string
+		TemplateVersion       int
+		NetworkName           string
+		NetworkModel          string
+		NetworkInfo           *NetworkInfo
+		VMAffinity            string
+		KeyPairName           string
+		UserData              string
+		NetworkData           string
+		EnableEFI             bool
+		EnableSecureBoot      bool
+		VGPUInfo              *VGPUInfo
+		CPUPinning            bool
+		IsolateEmulatorThread bool
+		EnableTPM             bool
+	}{
+		CPU:                   d.CPU,
+		CPUModel:              d.CPUModel,
+		MemorySize:            d.MemorySize,
+		ReservedMemorySize:    d.ReservedMemorySize,
+		DiskSize:              d.DiskSize,
+		DiskBus:               d.DiskBus,
+		ImageName:             d.ImageName,
+		DiskInfo:              d.DiskInfo,
+		RestoreFrom:           d.RestoreFrom,
+		RestoreDataDisks:      d.RestoreDataDisks,
+		TemplateName:          d.TemplateName,
+		TemplateVersion:       d.TemplateVersion,
+		NetworkName:           d.NetworkName,
+		NetworkModel:          d.NetworkModel,
+		NetworkInfo:           d.NetworkInfo,
+		VMAffinity:            d.VMAffinity,
+		KeyPairName:           d.KeyPairName,
+		UserData:              d.UserData,
+		NetworkData:           d.NetworkData,
+		EnableEFI:             d.EnableEFI,
+		EnableSecureBoot:      d.EnableSecureBoot,
+		VGPUInfo:              d.VGPUInfo,
+		CPUPinning:            d.CPUPinning,
+		IsolateEmulatorThread: d.IsolateEmulatorThread,
+		EnableTPM:             d.EnableTPM,
+	})
+	if err != nil {
+		return "", err
+	}
+	hasher := fnv.New64a()
+	if _, err = hasher.Write(spec); err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(hasher.Sum64(), 16), nil
+}
+
+// checkResumableVM verifies that an existing VM was created by this driver
+// from the same config, so that Create can resume it.
+func (d *Driver) checkResumableVM(vm *kubevirtv1.VirtualMachine, specHash string) error {
+	if !d.isOwnedVM(vm) {
+		return fmt.Errorf("machine %s already exists in namespace %s and was not created by this driver", d.MachineName, d.VMNamespace)
+	}
+	if vm.Annotations[machineSpecHashAnnotationKey] != specHash {
+		return fmt.Errorf("machine %s already exists in namespace %s but was created from a different config", d.MachineName, d.VMNamespace)
+	}
+	return nil
+}
+
+// setProvisioningPhase records that Create completed phase for the VM.
+func (d *Driver) setProvisioningPhase(phase string) error {
+	log.Debugf("Machine %s reached provisioning phase %s", d.MachineName, phase)
+	_, err := d.patchVMAnnotations(map[string]string{provisioningPhaseAnnotationKey: phase})
+	return err
+}
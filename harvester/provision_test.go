@@ -0,0 +1,146 @@
+package harvester
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	"github.com/harvester/harvester/pkg/builder"
+)
+
+func TestSpecHash(t *testing.T) {
+	d := NewDriver("test-machine", "")
+	d.CPU = 2
+	d.MemorySize = "4Gi"
+	hash, err := d.specHash()
+	require.NoError(t, err)
+
+	sameHash, err := d.specHash()
+	require.NoError(t, err)
+	require.Equal(t, hash, sameHash)
+
+	d.CPU = 4
+	otherHash, err := d.specHash()
+	require.NoError(t, err)
+	require.NotEqual(t, hash, otherHash)
+}
+
+func TestSpecHashIgnoresGeneratedKey(t *testing.T) {
+	d, _, _ := newFakeDriver()
+	d.CPU = 2
+	d.SSHUser = "ubuntu"
+	d.SSHPublicKey = "ssh-ed25519 AAAAfirst"
+	// large user data is saved in the cloud-init secret
+	d.UserData = "#cloud-config\nruncmd:\n- echo " + strings.Repeat("x", cloudInitNoCloudLimitSize)
+	hash, err := d.specHash()
+	require.NoError(t, err)
+	_, secret, err := d.buildCloudInit()
+	require.NoError(t, err)
+	require.NoError(t, d.createOrUpdateSecret(secret))
+
+	// the generated key is not part of the machine config
+	d.SSHPublicKey = "ssh-ed25519 AAAAsecond"
+	resumedHash, err := d.specHash()
+	require.NoError(t, err)
+	require.Equal(t, hash, resumedHash)
+	vm := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{builder.LabelKeyVirtualMachineCreator: vmCreator},
+			Annotations: map[string]string{
+				machineNameAnnotationKey:     "test-machine",
+				machineSpecHashAnnotationKey: hash,
+			},
+		},
+	}
+	require.NoError(t, d.checkResumableVM(vm, resumedHash))
+
+	_, secret, err = d.buildCloudInit()
+	require.NoError(t, err)
+	require.NoError(t, d.createOrUpdateSecret(secret))
+	saved, err := d.getSecret(d.VMNamespace, d.cloudInitSecretName())
+	require.NoError(t, err)
+	require.Contains(t, string(saved.Data["userdata"]), "AAAAsecond")
+	require.NotContains(t, string(saved.Data["userdata"]), "AAAAfirst")
+
+	d.KeyPairName = "default/my-key"
+	otherHash, err := d.specHash()
+	require.NoError(t, err)
+	require.NotEqual(t, hash, otherHash)
+}
+
+func TestResumeRestoresSavedSSHKey(t *testing.T) {
+	d, _, _ := newFakeDriver()
+	d.StorePath = t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Dir(d.GetSSHKeyPath()), 0700))
+	require.NoError(t, d.createKeyPair())
+	generatedKey := d.SSHPublicKey
+	privateKey, err := os.ReadFile(d.GetSSHKeyPath())
+	require.NoError(t, err)
+
+	// a retried Create, after the machine store lost the key, keeps the key
+	// the VM was created with
+	require.NoError(t, os.Remove(d.GetSSHKeyPath()))
+	require.NoError(t, os.Remove(d.GetSSHKeyPath()+".pub"))
+	d.SSHPublicKey = ""
+	require.NoError(t, d.createKeyPair())
+	require.Equal(t, generatedKey, d.SSHPublicKey)
+	restoredKey, err := os.ReadFile(d.GetSSHKeyPath())
+	require.NoError(t, err)
+	require.Equal(t, privateKey, restoredKey)
+
+	vm := &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: "test-machine", UID: "vm-uid"}}
+	require.NoError(t, d.adoptSSHKeySecret(vm))
+	require.NoError(t, d.adoptSSHKeySecret(vm))
+	secret, err := d.getSecret(defaultNamespace, d.sshKeySecretName())
+	require.NoError(t, err)
+	require.Len(t, secret.OwnerReferences, 1)
+	require.Equal(t, vm.UID, secret.OwnerReferences[0].UID)
+}
+
+func TestRestoreSSHKeyOfOtherMachine(t *testing.T) {
+	d, _, _ := newFakeDriver(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-machine-sshkey", Namespace: defaultNamespace},
+	})
+	_, err := d.restoreSSHKey(filepath.Join(t.TempDir(), "id_rsa"))
+	require.EqualError(t, err, "secret default/test-machine-sshkey already exists and was not created for machine test-machine")
+}
+
+func TestCheckResumableVM(t *testing.T) {
+	d := NewDriver("test-machine", "")
+	newVM := func(creator, machineName, specHash string) *kubevirtv1.VirtualMachine {
+		return &kubevirtv1.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: map[string]string{builder.LabelKeyVirtualMachineCreator: creator},
+				Annotations: map[string]string{
+					machineNameAnnotationKey:     machineName,
+					machineSpecHashAnnotationKey: specHash,
+				},
+			},
+		}
+	}
+
+	require.NoError(t, d.checkResumableVM(newVM(vmCreator, "test-machine", "abc"), "abc"))
+	require.ErrorContains(t, d.checkResumableVM(newVM("harvester", "test-machine", "abc"), "abc"), "not created by this driver")
+	require.ErrorContains(t, d.checkResumableVM(newVM(vmCreator, "other-machine", "abc"), "abc"), "not created by this driver")
+	require.ErrorContains(t, d.checkResumableVM(newVM(vmCreator, "test-machine", "def"), "abc"), "different config")
+}
+
+func TestProvisioningPhaseReached(t *testing.T) {
+	vm := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{provisioningPhaseAnnotationKey: provisioningPhaseSecretCreated},
+		},
+	}
+	require.True(t, provisioningPhaseReached(vm, provisioningPhaseVMCreated))
+	require.True(t, provisioningPhaseReached(vm, provisioningPhaseSecretCreated))
+	require.False(t, provisioningPhaseReached(vm, provisioningPhaseReady))
+
+	vm.Annotations[provisioningPhaseAnnotationKey] = "unknown"
+	require.False(t, provisioningPhaseReached(vm, provisioningPhaseVMCreated))
+}
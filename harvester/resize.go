@@ -0,0 +1,260 @@
+package harvester
+
+import (
+	"fmt"
+	"strings"
+
+	harvesterutil "github.com/harvester/harvester/pkg/util"
+	"github.com/rancher/machine/libmachine/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/util/retry"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// Resize changes the CPU count and the memory size (in GiB) of the machine,
+// zero keeps the current value. The machine is resized live through CPU and
+// memory hotplug when the VM enables it and the new size fits its maximum,
+// and restarted otherwise if it is running. It is run by the resize command.
+func (d *Driver) Resize(cpu, memorySize int) error {
+	return d.withTimeout(operationResize, d.ResizeTimeout, func() error {
+		return d.resize(cpu, memorySize)
+	})
+}
+
+func (d *Driver) resize(cpu, memorySize int) error {
+	log.Debugf("Resize node")
+	if cpu < 0 || memorySize < 0 {
+		return fmt.Errorf("invalid size of %d CPUs and %dGi memory", cpu, memorySize)
+	}
+	var memory *resource.Quantity
+	if memorySize > 0 {
+		memory = resource.NewQuantity(int64(memorySize)<<30, resource.BinarySI)
+	}
+
+	var (
+		vm      *kubevirtv1.VirtualMachine
+		hotplug bool
+	)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := d.getVM()
+		if err != nil {
+			return err
+		}
+		resized, live, err := resizedVM(current, cpu, memory)
+		if err != nil {
+			return err
+		}
+		if err = d.checkResourceQuotas(resourceIncrease(current, resized)); err != nil {
+			return err
+		}
+		if vm, err = d.updateVM(resized); err != nil {
+			return err
+		}
+		hotplug = live
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if cpu > 0 {
+		d.CPU = cpu
+	}
+	if memory != nil {
+		d.MemorySize = fmt.Sprintf("%dGi", memorySize)
+	}
+
+	vmi, err := d.getVMI()
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			log.Infof("Machine %s is not running, it will start with the new size", d.MachineName)
+			return nil
+		}
+		return err
+	}
+	if hotplug {
+		applied, err := d.waitForHotplug(vm)
+		if err != nil || applied {
+			return err
+		}
+		log.Infof("Machine %s cannot be resized live, restarting it", d.MachineName)
+	}
+	if err = d.putVMSubResource(actionRestart); err != nil {
+		return err
+	}
+	return d.waitForRestart(string(vmi.UID))
+}
+
+// resizedVM returns a copy of vm with the new CPU count and memory, and
+// whether the change can be hotplugged. A nil memory keeps the current
+// memory.
+func resizedVM(vm *kubevirtv1.VirtualMachine, cpu int, memory *resource.Quantity) (*kubevirtv1.VirtualMachine, bool, error) {
+	resized := vm.DeepCopy()
+	domain := &resized.Spec.Template.Spec.Domain
+	if domain.CPU == nil {
+		domain.CPU = &kubevirtv1.CPU{Cores: 1, Sockets: 1, Threads: 1}
+	}
+	if domain.Resources.Limits == nil {
+		domain.Resources.Limits = corev1.ResourceList{}
+	}
+	if !hotplugEnabled(vm) {
+		if cpu > 0 {
+			perCore := int(domain.CPU.Sockets * domain.CPU.Threads)
+			if perCore == 0 || cpu%perCore != 0 {
+				domain.CPU.Sockets, domain.CPU.Threads = 1, 1
+				perCore = 1
+			}
+			domain.CPU.Cores = uint32(cpu / perCore) //nolint:gosec
+			domain.Resources.Limits[corev1.ResourceCPU] = *resource.NewQuantity(int64(cpu), resource.DecimalSI)
+		}
+		if memory != nil {
+			// Harvester derives the requests and the guest memory from the limits
+			domain.Resources.Limits[corev1.ResourceMemory] = *memory
+		}
+		return resized, false, nil
+	}
+
+	// like the Harvester hotplug action, only the sockets and the guest
+	// memory change; raising their maximum requires a restart
+	live := domain.CPU.Cores == 1 && domain.CPU.Threads == 1 && !hasVMCondition(vm, kubevirtv1.VirtualMachineRestartRequired)
+	if cpu > 0 {
+		perSocket := int(domain.CPU.Cores * domain.CPU.Threads)
+		if perSocket == 0 || cpu%perSocket != 0 {
+			return nil, false, fmt.Errorf("%d CPUs is not a multiple of the %d CPUs per socket of machine %s", cpu, perSocket, vm.Name)
+		}
+		domain.CPU.Sockets = uint32(cpu / perSocket) //nolint:gosec
+		if domain.CPU.MaxSockets > 0 && domain.CPU.Sockets > domain.CPU.MaxSockets {
+			domain.CPU.MaxSockets = domain.CPU.Sockets
+			live = false
+		}
+	}
+	if memory != nil {
+		if domain.Memory == nil {
+			domain.Memory = &kubevirtv1.Memory{}
+		}
+		domain.Memory.Guest = memory
+		if maxGuest := domain.Memory.MaxGuest; maxGuest != nil && memory.Cmp(*maxGuest) > 0 {
+			domain.Memory.MaxGuest = memory
+			live = false
+		}
+	}
+	return resized, live, nil
+}
+
+// hotplugEnabled reports whether CPU and memory hotplug is enabled on vm.
+func hotplugEnabled(vm *kubevirtv1.VirtualMachine) bool {
+	return strings.EqualFold(vm.Annotations[harvesterutil.AnnotationEnableCPUAndMemoryHotplug], "true")
+}
+
+func hasVMCondition(vm *kubevirtv1.VirtualMachine, conditionType kubevirtv1.VirtualMachineConditionType) bool {
+	for _, condition := range vm.Status.Conditions {
+		if condition.Type == conditionType && condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForHotplug waits for the running machine to reflect the CPU and
+// memory of vm. It returns false if KubeVirt requires a restart instead.
+func (d *Driver) waitForHotplug(vm *kubevirtv1.VirtualMachine) (bool, error) {
+	domain := vm.Spec.Template.Spec.Domain
+	restartRequired := false
+	applied := func() (bool, error) {
+		current, err := d.getVM()
+		if err != nil {
+			return false, err
+		}
+		if hasVMCondition(current, kubevirtv1.VirtualMachineRestartRequired) {
+			restartRequired = true
+			return true, nil
+		}
+		vmi, err := d.getVMI()
+		if err != nil {
+			return false, err
+		}
+		if topology := vmi.Status.CurrentCPUTopology; topology != nil && domain.CPU != nil && topology.Sockets != domain.CPU.Sockets {
+			return false, nil
+		}
+		if domain.Memory != nil && domain.Memory.Guest != nil {
+			if vmi.Status.Memory == nil || vmi.Status.Memory.GuestCurrent == nil || !vmi.Status.Memory.GuestCurrent.Equal(*domain.Memory.Guest) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	log.Debugf("Waiting for node resized")
+	if err := d.waitFor("machine resized", applied); err != nil {
+		return false, err
+	}
+	return !restartRequired, nil
+}
+
+// resourceIncrease returns how much the CPU and memory limits of resized
+// exceed those of vm, for the limits which increase.
+func resourceIncrease(vm, resized *kubevirtv1.VirtualMachine) corev1.ResourceList {
+	increase := corev1.ResourceList{}
+	oldCPU, newCPU := vmCPU(vm), vmCPU(resized)
+	if newCPU.Cmp(oldCPU) > 0 {
+		newCPU.Sub(oldCPU)
+		increase[corev1.ResourceLimitsCPU] = newCPU
+	}
+	oldMemory, newMemory := vmMemory(vm), vmMemory(resized)
+	if newMemory.Cmp(oldMemory) > 0 {
+		newMemory.Sub(oldMemory)
+		increase[corev1.ResourceLimitsMemory] = newMemory
+	}
+	return increase
+}
+
+// vmCPU returns the CPU count of vm, which for hotplug VMs is given by the
+// sockets rather than the limits.
+func vmCPU(vm *kubevirtv1.VirtualMachine) resource.Quantity {
+	domain := vm.Spec.Template.Spec.Domain
+	if cpu := domain.CPU; cpu != nil && hotplugEnabled(vm) {
+		return *resource.NewQuantity(int64(cpu.Sockets*cpu.Cores*cpu.Threads), resource.DecimalSI)
+	}
+	return domain.Resources.Limits.Cpu().DeepCopy()
+}
+
+// vmMemory returns the memory of vm, which for hotplug VMs is given by the
+// guest memory rather than the limits.
+func vmMemory(vm *kubevirtv1.VirtualMachine) resource.Quantity {
+	domain := vm.Spec.Template.Spec.Domain
+	if memory := domain.Memory; memory != nil && memory.Guest != nil && hotplugEnabled(vm) {
+		return memory.Guest.DeepCopy()
+	}
+	return domain.Resources.Limits.Memory().DeepCopy()
+}
+
+// checkResourceQuotas checks that the resource quotas of the namespace
+// leave room for increase.
+func (d *Driver) checkResourceQuotas(increase corev1.ResourceList) error {
+	if len(increase) == 0 {
+		return nil
+	}
+	quotas, err := d.listResourceQuotas()
+	if err != nil {
+		return err
+	}
+	return checkResourceQuotas(quotas.Items, increase)
+}
+
+func checkResourceQuotas(quotas []corev1.ResourceQuota, increase corev1.ResourceList) error {
+	for _, quota := range quotas {
+		for name, value := range increase {
+			hard, ok := quota.Status.Hard[name]
+			if !ok {
+				continue
+			}
+			required := quota.Status.Used[name]
+			required.Add(value)
+			if required.Cmp(hard) > 0 {
+				used := quota.Status.Used[name]
+				return fmt.Errorf("resource quota %s allows %s %s, %s are used and %s more are required", quota.Name, hard.String(), name, used.String(), value.String())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package harvester
+
+import (
+	"testing"
+
+	harvesterutil "github.com/harvester/harvester/pkg/util"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func testResizeVM(hotplug bool) *kubevirtv1.VirtualMachine {
+	vm := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-machine", Annotations: map[string]string{}},
+		Spec: kubevirtv1.VirtualMachineSpec{
+			Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
+				Spec: kubevirtv1.VirtualMachineInstanceSpec{
+					Domain: kubevirtv1.DomainSpec{
+						CPU: &kubevirtv1.CPU{Cores: 2, Sockets: 1, Threads: 1},
+						Resources: kubevirtv1.ResourceRequirements{
+							Limits: corev1.ResourceList{
+								corev1.ResourceCPU:    resource.MustParse("2"),
+								corev1.ResourceMemory: resource.MustParse("4Gi"),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if hotplug {
+		vm.Annotations[harvesterutil.AnnotationEnableCPUAndMemoryHotplug] = "true"
+		vm.Spec.Template.Spec.Domain.CPU = &kubevirtv1.CPU{Cores: 1, Sockets: 2, Threads: 1, MaxSockets: 8}
+		vm.Spec.Template.Spec.Domain.Memory = &kubevirtv1.Memory{
+			Guest:    ptr.To(resource.MustParse("4Gi")),
+			MaxGuest: ptr.To(resource.MustParse("16Gi")),
+		}
+	}
+	return vm
+}
+
+func TestResizedVM(t *testing.T) {
+	resized, live, err := resizedVM(testResizeVM(false), 4, ptr.To(resource.MustParse("8Gi")))
+	require.NoError(t, err)
+	require.False(t, live)
+	domain := resized.Spec.Template.Spec.Domain
+	require.Equal(t, uint32(4), domain.CPU.Cores)
+	require.Equal(t, "4", ptr.To(domain.Resources.Limits[corev1.ResourceCPU]).String())
+	require.Equal(t, "8Gi", ptr.To(domain.Resources.Limits[corev1.ResourceMemory]).String())
+
+	resized, live, err = resizedVM(testResizeVM(true), 4, ptr.To(resource.MustParse("8Gi")))
+	require.NoError(t, err)
+	require.True(t, live)
+	domain = resized.Spec.Template.Spec.Domain
+	require.Equal(t, uint32(4), domain.CPU.Sockets)
+	require.Equal(t, "8Gi", domain.Memory.Guest.String())
+	require.Equal(t, "2", ptr.To(domain.Resources.Limits[corev1.ResourceCPU]).String())
+
+	// growing beyond the maximum raises it, which requires a restart
+	resized, live, err = resizedVM(testResizeVM(true), 10, nil)
+	require.NoError(t, err)
+	require.False(t, live)
+	require.Equal(t, uint32(10), resized.Spec.Template.Spec.Domain.CPU.MaxSockets)
+	require.Equal(t, "4Gi", resized.Spec.Template.Spec.Domain.Memory.Guest.String())
+
+	vm := testResizeVM(true)
+	vm.Status.Conditions = []kubevirtv1.VirtualMachineCondition{
+		{Type: kubevirtv1.VirtualMachineRestartRequired, Status: corev1.ConditionTrue},
+	}
+	_, live, err = resizedVM(vm, 4, nil)
+	require.NoError(t, err)
+	require.False(t, live)
+}
+
+func TestResourceIncrease(t *testing.T) {
+	vm := testResizeVM(true)
+	resized, _, err := resizedVM(vm, 4, ptr.To(resource.MustParse("2Gi")))
+	require.NoError(t, err)
+	increase := resourceIncrease(vm, resized)
+	require.Len(t, increase, 1)
+	require.Equal(t, "2", ptr.To(increase[corev1.ResourceLimitsCPU]).String())
+}
+
+func TestCheckResourceQuotas(t *testing.T) {
+	quotas := []corev1.ResourceQuota{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "default-quota"},
+			Status: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourceLimitsCPU: resource.MustParse("8")},
+				Used: corev1.ResourceList{corev1.ResourceLimitsCPU: resource.MustParse("6")},
+			},
+		},
+	}
+	tests := []struct {
+		name     string
+		increase corev1.ResourceList
+		err      string
+	}{
+		{
+			name:     "within quota",
+			increase: corev1.ResourceList{corev1.ResourceLimitsCPU: resource.MustParse("2")},
+		},
+		{
+			name:     "exceeds quota",
+			increase: corev1.ResourceList{corev1.ResourceLimitsCPU: resource.MustParse("3")},
+			err:      "resource quota default-quota allows 8 limits.cpu, 6 are used and 3 more are required",
+		},
+		{
+			name:     "not limited",
+			increase: corev1.ResourceList{corev1.ResourceLimitsMemory: resource.MustParse("64Gi")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkResourceQuotas(quotas, tt.increase)
+			if tt.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package harvester
+
+import (
+	"fmt"
+	"sort"
+
+	harvsterv1 "github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
+	"github.com/harvester/harvester/pkg/builder"
+	harvesterutil "github.com/harvester/harvester/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/utils/ptr"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const (
+	// restoredDiskNamePrefix names the disks restored from a backup, so they
+	// do not collide with the disks of the harvester disk info.
+	restoredDiskNamePrefix = "restored-disk"
+
+	volumeSnapshotAPIGroup = "snapshot.storage.k8s.io"
+	volumeSnapshotKind     = "VolumeSnapshot"
+)
+
+// restoredDisk is a disk of the backed up VM together with the volume backup
+// it is restored from.
+type restoredDisk struct {
+	disk         kubevirtv1.Disk
+	hotpluggable bool
+	volumeBackup harvsterv1.VolumeBackup
+}
+
+// getRestoreBackup returns the backup or snapshot the machine is restored
+// from, which must be ready to use.
+func (d *Driver) getRestoreBackup() (*harvsterv1.VirtualMachineBackup, error) {
+	backup, err := d.getBackup(d.RestoreFrom)
+	if err != nil {
+		return nil, err
+	}
+	if backup.Status.Error != nil && backup.Status.Error.Message != nil {
+		return nil, fmt.Errorf("%s %s failed: %s", backup.Spec.Type, backup.Name, *backup.Status.Error.Message)
+	}
+	if !ptr.Deref(backup.Status.ReadyToUse, false) {
+		return nil, fmt.Errorf("%s %s is not ready to use", backup.Spec.Type, backup.Name)
+	}
+	return backup, nil
+}
+
+// restoredDisks returns the disks to restore from backup: the boot disk, and
+// the other disks backed by a volume if withDataDisks is set. The disks are
+// ordered by boot order, then as they are in the backed up VM.
+func restoredDisks(backup *harvsterv1.VirtualMachineBackup, namespace string, withDataDisks bool) ([]restoredDisk, error) {
+	if backup.Status.SourceSpec == nil {
+		return nil, fmt.Errorf("%s %s has no source VM spec", backup.Spec.Type, backup.Name)
+	}
+	volumeBackups := make(map[string]harvsterv1.VolumeBackup, len(backup.Status.VolumeBackups))
+	for _, volumeBackup := range backup.Status.VolumeBackups {
+		volumeBackups[volumeBackup.VolumeName] = volumeBackup
+	}
+	vmSpec := backup.Status.SourceSpec.Spec.Template.Spec
+	disks := make(map[string]kubevirtv1.Disk, len(vmSpec.Domain.Devices.Disks))
+	for _, disk := range vmSpec.Domain.Devices.Disks {
+		disks[disk.Name] = disk
+	}
+
+	var restored []restoredDisk
+	for _, volume := range vmSpec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		disk, ok := disks[volume.Name]
+		if !ok {
+			continue
+		}
+		volumeBackup, ok := volumeBackups[volume.Name]
+		if !ok || volumeBackup.Name == nil {
+			return nil, fmt.Errorf("%s %s has no backup of volume %s", backup.Spec.Type, backup.Name, volume.Name)
+		}
+		if volumeBackup.PersistentVolumeClaim.ObjectMeta.Namespace != namespace {
+			return nil, fmt.Errorf("volume %s of %s %s is in namespace %s, it can only be restored to a machine in the same namespace",
+				volume.Name, backup.Spec.Type, backup.Name, volumeBackup.PersistentVolumeClaim.ObjectMeta.Namespace)
+		}
+		restored = append(restored, restoredDisk{
+			disk:         disk,
+			hotpluggable: volume.PersistentVolumeClaim.Hotpluggable,
+			volumeBackup: volumeBackup,
+		})
+	}
+	if len(restored) == 0 {
+		return nil, fmt.Errorf("%s %s has no disk to restore", backup.Spec.Type, backup.Name)
+	}
+
+	// disks without a boot order come last
+	bootOrder := func(disk kubevirtv1.Disk) uint {
+		if disk.BootOrder == nil {
+			return ^uint(0)
+		}
+		return *disk.BootOrder
+	}
+	sort.SliceStable(restored, func(i, j int) bool {
+		return bootOrder(restored[i].disk) < bootOrder(restored[j].disk)
+	})
+	if !withDataDisks {
+		restored = restored[:1]
+	}
+	return restored, nil
+}
+
+// addRestoredDisk adds a disk whose volume is restored from the volume
+// snapshot of a backup.
+func (d *Driver) addRestoredDisk(vmBuilder *builder.VMBuilder, restored restoredDisk, diskIndex int) (*builder.VMBuilder, error) {
+	diskName := fmt.Sprintf("%s-%d", restoredDiskNamePrefix, diskIndex)
+	pvcName := fmt.Sprintf("%s-%s-%s", d.MachineName, diskName, rand.String(5))
+	pvcSpec := restored.volumeBackup.PersistentVolumeClaim.Spec
+
+	size, ok := pvcSpec.Resources.Requests[corev1.ResourceStorage]
+	if !ok {
+		return nil, fmt.Errorf("backup of volume %s has no size", restored.volumeBackup.VolumeName)
+	}
+	pvcOption := &builder.PersistentVolumeClaimOption{
+		ImageID:          restored.volumeBackup.PersistentVolumeClaim.ObjectMeta.Annotations[harvesterutil.AnnotationImageID],
+		StorageClassName: pvcSpec.StorageClassName,
+		VolumeMode:       ptr.Deref(pvcSpec.VolumeMode, corev1.PersistentVolumeBlock),
+		AccessMode:       corev1.ReadWriteMany,
+	}
+	if len(pvcSpec.AccessModes) > 0 {
+		pvcOption.AccessMode = pvcSpec.AccessModes[0]
+	}
+
+	var bus kubevirtv1.DiskBus
+	isCDRom := false
+	switch {
+	case restored.disk.Disk != nil:
+		bus = restored.disk.Disk.Bus
+	case restored.disk.CDRom != nil:
+		bus = restored.disk.CDRom.Bus
+		isCDRom = true
+	}
+	if bus == "" {
+		bus = defaultDiskBus
+	}
+	vmBuilder = vmBuilder.PVCDisk(diskName, string(bus), isCDRom, restored.hotpluggable, ptr.Deref(restored.disk.BootOrder, 0), size.String(), pvcName, pvcOption)
+	if err := setVolumeClaimDataSource(vmBuilder.VirtualMachine, pvcName, *restored.volumeBackup.Name); err != nil {
+		return nil, err
+	}
+	return vmBuilder, nil
+}
+
+// setVolumeClaimDataSource makes the claim with the given name in the volume
+// claim templates of vm restore the named volume snapshot.
+func setVolumeClaimDataSource(vm *kubevirtv1.VirtualMachine, pvcName, snapshotName string) error {
+	entries, err := harvesterutil.UnmarshalVolumeClaimTemplates(vm.Annotations[harvesterutil.AnnotationVolumeClaimTemplates])
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range entries {
+		if entries[i].Name != pvcName {
+			continue
+		}
+		entries[i].Spec.DataSource = &corev1.TypedLocalObjectReference{
+			APIGroup: ptr.To(volumeSnapshotAPIGroup),
+			Kind:     volumeSnapshotKind,
+			Name:     snapshotName,
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("volume claim template %s not found", pvcName)
+	}
+	data, err := harvesterutil.MarshalVolumeClaimTemplates(entries)
+	if err != nil {
+		return err
+	}
+	vm.Annotations[harvesterutil.AnnotationVolumeClaimTemplates] = data
+	return nil
+}
@@ -0,0 +1,124 @@
+package harvester
+
+import (
+	"testing"
+
+	harvsterv1 "github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
+	"github.com/harvester/harvester/pkg/builder"
+	harvesterutil "github.com/harvester/harvester/pkg/util"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func testRestoreBackup(namespace string) *harvsterv1.VirtualMachineBackup {
+	pvcVolume := func(name string) kubevirtv1.Volume {
+		return kubevirtv1.Volume{
+			Name: name,
+			VolumeSource: kubevirtv1.VolumeSource{
+				PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
+					PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{ClaimName: "source-" + name},
+				},
+			},
+		}
+	}
+	volumeBackup := func(name string) harvsterv1.VolumeBackup {
+		return harvsterv1.VolumeBackup{
+			Name:       ptr.To("snapshot-" + name),
+			VolumeName: name,
+			PersistentVolumeClaim: harvsterv1.PersistentVolumeClaimSourceSpec{
+				ObjectMeta: metav1.ObjectMeta{Name: "source-" + name, Namespace: namespace},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany},
+					Resources: corev1.VolumeResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")},
+					},
+					StorageClassName: ptr.To("longhorn"),
+				},
+			},
+		}
+	}
+	return &harvsterv1.VirtualMachineBackup{
+		ObjectMeta: metav1.ObjectMeta{Name: "golden", Namespace: "default"},
+		Spec:       harvsterv1.VirtualMachineBackupSpec{Type: harvsterv1.Snapshot},
+		Status: harvsterv1.VirtualMachineBackupStatus{
+			SourceSpec: &harvsterv1.VirtualMachineSourceSpec{
+				Spec: kubevirtv1.VirtualMachineSpec{
+					Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
+						Spec: kubevirtv1.VirtualMachineInstanceSpec{
+							Domain: kubevirtv1.DomainSpec{
+								Devices: kubevirtv1.Devices{
+									Disks: []kubevirtv1.Disk{
+										{Name: "data", DiskDevice: kubevirtv1.DiskDevice{Disk: &kubevirtv1.DiskTarget{Bus: "scsi"}}},
+										{Name: "root", BootOrder: ptr.To(uint(1)), DiskDevice: kubevirtv1.DiskDevice{Disk: &kubevirtv1.DiskTarget{Bus: "virtio"}}},
+										{Name: "cloudinitdisk"},
+									},
+								},
+							},
+							Volumes: []kubevirtv1.Volume{
+								pvcVolume("data"),
+								pvcVolume("root"),
+								{Name: "cloudinitdisk", VolumeSource: kubevirtv1.VolumeSource{CloudInitNoCloud: &kubevirtv1.CloudInitNoCloudSource{}}},
+							},
+						},
+					},
+				},
+			},
+			VolumeBackups: []harvsterv1.VolumeBackup{volumeBackup("data"), volumeBackup("root")},
+		},
+	}
+}
+
+func TestRestoredDisks(t *testing.T) {
+	backup := testRestoreBackup("default")
+
+	disks, err := restoredDisks(backup, "default", false)
+	require.NoError(t, err)
+	require.Len(t, disks, 1)
+	require.Equal(t, "root", disks[0].disk.Name)
+	require.Equal(t, "snapshot-root", *disks[0].volumeBackup.Name)
+
+	disks, err = restoredDisks(backup, "default", true)
+	require.NoError(t, err)
+	require.Len(t, disks, 2)
+	require.Equal(t, "root", disks[0].disk.Name)
+	require.Equal(t, "data", disks[1].disk.Name)
+
+	_, err = restoredDisks(testRestoreBackup("other"), "default", false)
+	require.ErrorContains(t, err, "can only be restored to a machine in the same namespace")
+
+	backup.Status.VolumeBackups = backup.Status.VolumeBackups[:1]
+	_, err = restoredDisks(backup, "default", false)
+	require.ErrorContains(t, err, "has no backup of volume root")
+}
+
+func TestAddRestoredDisk(t *testing.T) {
+	d := NewDriver("test-machine", "")
+	d.VMNamespace = "default"
+	disks, err := restoredDisks(testRestoreBackup("default"), "default", false)
+	require.NoError(t, err)
+
+	vmBuilder := builder.NewVMBuilder(vmCreator).Namespace(d.VMNamespace).Name(d.MachineName)
+	vmBuilder, err = d.addRestoredDisk(vmBuilder, disks[0], 0)
+	require.NoError(t, err)
+	vm, err := vmBuilder.VM()
+	require.NoError(t, err)
+
+	require.Len(t, vm.Spec.Template.Spec.Volumes, 1)
+	volume := vm.Spec.Template.Spec.Volumes[0]
+	require.Equal(t, "restored-disk-0", volume.Name)
+
+	entries, err := harvesterutil.UnmarshalVolumeClaimTemplates(vm.Annotations[harvesterutil.AnnotationVolumeClaimTemplates])
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, volume.PersistentVolumeClaim.ClaimName, entries[0].Name)
+	require.Equal(t, &corev1.TypedLocalObjectReference{
+		APIGroup: ptr.To(volumeSnapshotAPIGroup),
+		Kind:     volumeSnapshotKind,
+		Name:     "snapshot-root",
+	}, entries[0].Spec.DataSource)
+	require.Equal(t, "10Gi", ptr.To(entries[0].Spec.Resources.Requests[corev1.ResourceStorage]).String())
+}
@@ -0,0 +1,179 @@
+package harvester
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/rancher/machine/libmachine/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const (
+	diskRetainPolicyDelete = "delete"
+	diskRetainPolicyRetain = "retain"
+
+	// retainedFromMachineLabelKey labels volumes retained when their machine
+	// was removed, so they can be found and attached to a replacement.
+	retainedFromMachineLabelKey = "harvesterhci.io/retainedFromMachine"
+	// retainedDiskAnnotationKey records the disk name the retained volume was
+	// attached as.
+	retainedDiskAnnotationKey = "harvesterhci.io/retainedDisk"
+	// diskRetainPolicyAnnotationKey records the retain policy a volume was
+	// hotplugged with, which is not kept in the disk info of every machine.
+	diskRetainPolicyAnnotationKey = "harvesterhci.io/diskRetainPolicy"
+)
+
+// diskRetainPolicy returns the retain policy of the disk attached as the VM
+// volume with the given name.
+func (d *Driver) diskRetainPolicy(volumeName string) string {
+	policy := d.DiskRetainPolicy
+	if index, ok := diskIndex(volumeName); ok && d.DiskInfo != nil && index < len(d.DiskInfo.Disks) {
+		if diskPolicy := d.DiskInfo.Disks[index].RetainPolicy; diskPolicy != "" {
+			policy = diskPolicy
+		}
+	}
+	if policy == "" {
+		return defaultDiskRetainPolicy
+	}
+	return policy
+}
+
+// diskIndex parses the index of a disk from a volume name built by addDisk.
+func diskIndex(volumeName string) (int, bool) {
+	suffix, ok := strings.CutPrefix(volumeName, diskNamePrefix+"-")
+	if !ok {
+		return 0, false
+	}
+	index, err := strconv.Atoi(suffix)
+	if err != nil || index < 0 {
+		return 0, false
+	}
+	return index, true
+}
+
+// retainedPVCs returns the claims of the VM which must survive its removal,
+// mapped to the name of the disk they are attached as.
+func (d *Driver) retainedPVCs(vm *kubevirtv1.VirtualMachine, hotplugged map[string]string) map[string]string {
+	retained := make(map[string]string)
+	for _, volume := range vm.Spec.Template.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		policy, ok := hotplugged[volume.PersistentVolumeClaim.ClaimName]
+		if !ok {
+			policy = d.diskRetainPolicy(volume.Name)
+		}
+		if policy == diskRetainPolicyRetain {
+			retained[volume.PersistentVolumeClaim.ClaimName] = volume.Name
+		}
+	}
+	return retained
+}
+
+// hotpluggedClaims returns the retain policies of the claims AddVolume
+// hotplugged into vm, by claim name. Claims hotplugged by other means are not
+// included, since they are not owned by the machine.
+func (d *Driver) hotpluggedClaims(vm *kubevirtv1.VirtualMachine) (map[string]string, error) {
+	policies := make(map[string]string)
+	for _, volume := range vm.Spec.Template.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil || !volume.PersistentVolumeClaim.Hotpluggable {
+			continue
+		}
+		claimName := volume.PersistentVolumeClaim.ClaimName
+		pvc, err := d.getPVC(claimName)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if pvc.Annotations[machineNameAnnotationKey] != d.MachineName {
+			continue
+		}
+		policy := pvc.Annotations[diskRetainPolicyAnnotationKey]
+		if policy == "" {
+			policy = d.diskRetainPolicy(volume.Name)
+		}
+		policies[claimName] = policy
+	}
+	return policies, nil
+}
+
+// detachRetainedVolumes removes the volumes of the retained claims, and their
+// disks, from vm. Harvester sets a VM as the owner of the claims in its spec,
+// so they would be garbage collected with the VM otherwise.
+func detachRetainedVolumes(vm *kubevirtv1.VirtualMachine, retained map[string]string) {
+	if len(retained) == 0 {
+		return
+	}
+	spec := &vm.Spec.Template.Spec
+	detached := make(map[string]bool)
+	volumes := spec.Volumes[:0]
+	for _, volume := range spec.Volumes {
+		if volume.PersistentVolumeClaim != nil {
+			if _, ok := retained[volume.PersistentVolumeClaim.ClaimName]; ok {
+				detached[volume.Name] = true
+				continue
+			}
+		}
+		volumes = append(volumes, volume)
+	}
+	spec.Volumes = volumes
+	disks := spec.Domain.Devices.Disks[:0]
+	for _, disk := range spec.Domain.Devices.Disks {
+		if !detached[disk.Name] {
+			disks = append(disks, disk)
+		}
+	}
+	spec.Domain.Devices.Disks = disks
+}
+
+// retainPVCs labels the retained claims for later re-attachment and removes
+// the VM from their owners, so they are not garbage collected with it. The
+// claims must have been detached from the VM by patchRemovedPVCs before.
+func (d *Driver) retainPVCs(vm *kubevirtv1.VirtualMachine, retained map[string]string) error {
+	if len(retained) == 0 {
+		return nil
+	}
+	c, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	machineLabelValue, err := formatLabelValue(d.MachineName)
+	if err != nil {
+		return err
+	}
+	for claimName, diskName := range retained {
+		pvc, err := c.KubeClient.CoreV1().PersistentVolumeClaims(d.VMNamespace).Get(d.ctx, claimName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		pvcCopy := pvc.DeepCopy()
+		if pvcCopy.Labels == nil {
+			pvcCopy.Labels = map[string]string{}
+		}
+		// the cluster label is not added, since removing all the volumes of
+		// the cluster must not delete retained volumes
+		pvcCopy.Labels[retainedFromMachineLabelKey] = machineLabelValue
+		if pvcCopy.Annotations == nil {
+			pvcCopy.Annotations = map[string]string{}
+		}
+		pvcCopy.Annotations[retainedDiskAnnotationKey] = diskName
+
+		ownerReferences := pvcCopy.OwnerReferences[:0]
+		for _, ownerReference := range pvcCopy.OwnerReferences {
+			if ownerReference.UID != vm.UID {
+				ownerReferences = append(ownerReferences, ownerReference)
+			}
+		}
+		pvcCopy.OwnerReferences = ownerReferences
+
+		if _, err = c.KubeClient.CoreV1().PersistentVolumeClaims(d.VMNamespace).Update(d.ctx, pvcCopy, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		log.Infof("Retained volume %s of machine %s", claimName, d.MachineName)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package harvester
+
+import (
+	"strings"
+	"testing"
+
+	harvesterutil "github.com/harvester/harvester/pkg/util"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func TestRetainedPVCs(t *testing.T) {
+	pvcVolume := func(name, claimName string) kubevirtv1.Volume {
+		return kubevirtv1.Volume{
+			Name: name,
+			VolumeSource: kubevirtv1.VolumeSource{
+				PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
+					PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+				},
+			},
+		}
+	}
+	vm := &kubevirtv1.VirtualMachine{}
+	vm.Spec.Template = &kubevirtv1.VirtualMachineInstanceTemplateSpec{}
+	vm.Spec.Template.Spec.Volumes = []kubevirtv1.Volume{
+		pvcVolume("disk-0", "test-machine-disk-0-abcde"),
+		pvcVolume("disk-1", "test-machine-disk-1-fghij"),
+		{Name: "cloudinitdisk"},
+	}
+
+	tests := []struct {
+		name         string
+		globalPolicy string
+		diskInfo     *DiskInfo
+		want         map[string]string
+	}{
+		{
+			name: "delete by default",
+			want: map[string]string{},
+		},
+		{
+			name:         "global retain policy",
+			globalPolicy: diskRetainPolicyRetain,
+			want: map[string]string{
+				"test-machine-disk-0-abcde": "disk-0",
+				"test-machine-disk-1-fghij": "disk-1",
+			},
+		},
+		{
+			name:         "disk policy overrides global policy",
+			globalPolicy: diskRetainPolicyRetain,
+			diskInfo: &DiskInfo{Disks: []Disk{
+				{RetainPolicy: diskRetainPolicyDelete},
+				{},
+			}},
+			want: map[string]string{"test-machine-disk-1-fghij": "disk-1"},
+		},
+		{
+			name: "retain a data disk",
+			diskInfo: &DiskInfo{Disks: []Disk{
+				{},
+				{RetainPolicy: diskRetainPolicyRetain},
+			}},
+			want: map[string]string{"test-machine-disk-1-fghij": "disk-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDriver("test-machine", "")
+			d.DiskRetainPolicy = tt.globalPolicy
+			d.DiskInfo = tt.diskInfo
+			require.Equal(t, tt.want, d.retainedPVCs(vm, nil))
+		})
+	}
+}
+
+func TestCheckDiskRetainPolicy(t *testing.T) {
+	require.NoError(t, checkDiskRetainPolicy(""))
+	require.NoError(t, checkDiskRetainPolicy(diskRetainPolicyRetain))
+	require.EqualError(t, checkDiskRetainPolicy("keep"), `invalid disk retain policy "keep", must be "delete" or "retain"`)
+}
+
+func TestRemoveAllPVCsKeepsRetainedPVCs(t *testing.T) {
+	pvc := func(name string, labels map[string]string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: defaultNamespace, Labels: labels},
+		}
+	}
+	vm := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-machine",
+			Namespace:   defaultNamespace,
+			Annotations: map[string]string{removeAllPVCsAnnotationKey: "true"},
+		},
+		Spec: kubevirtv1.VirtualMachineSpec{
+			Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
+				Spec: kubevirtv1.VirtualMachineInstanceSpec{
+					Domain: kubevirtv1.DomainSpec{
+						Devices: kubevirtv1.Devices{
+							Disks: []kubevirtv1.Disk{{Name: "disk-0"}, {Name: "disk-1"}},
+						},
+					},
+					Volumes: []kubevirtv1.Volume{
+						{
+							Name: "disk-0",
+							VolumeSource: kubevirtv1.VolumeSource{
+								PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
+									PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{ClaimName: "test-machine-disk-0"},
+								},
+							},
+						},
+						{
+							Name: "disk-1",
+							VolumeSource: kubevirtv1.VolumeSource{
+								PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
+									PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{ClaimName: "test-machine-disk-1"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	d, _, _ := newFakeDriver(
+		vm,
+		pvc("test-machine-disk-0", map[string]string{clusterNameLabelKey: "test-cluster"}),
+		pvc("test-machine-disk-1", map[string]string{clusterNameLabelKey: "test-cluster"}),
+		pvc("test-machine-disk-2", map[string]string{clusterNameLabelKey: "test-cluster"}),
+		pvc("removed-machine-disk-1", map[string]string{
+			clusterNameLabelKey:         "test-cluster",
+			retainedFromMachineLabelKey: "removed-machine",
+		}),
+		pvc("other-machine-disk-0", map[string]string{clusterNameLabelKey: "other-cluster"}),
+	)
+	d.ClusterName = "test-cluster"
+	d.DiskInfo = &DiskInfo{Disks: []Disk{{}, {RetainPolicy: diskRetainPolicyRetain}}}
+
+	retained := d.retainedPVCs(vm, nil)
+	patchedVM, err := d.patchRemovedPVCs(vm, nil, retained)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"test-machine-disk-0", "test-machine-disk-2"},
+		strings.Split(patchedVM.Annotations[harvesterutil.RemovedPVCsAnnotationKey], ","))
+
+	// the retained volume is detached, so Harvester does not make the VM its
+	// owner again before the VM is deleted
+	storedVM, err := d.getVM()
+	require.NoError(t, err)
+	require.Len(t, storedVM.Spec.Template.Spec.Volumes, 1)
+	require.Equal(t, "disk-0", storedVM.Spec.Template.Spec.Volumes[0].Name)
+	require.Equal(t, []kubevirtv1.Disk{{Name: "disk-0"}}, storedVM.Spec.Template.Spec.Domain.Devices.Disks)
+
+	require.NoError(t, d.retainPVCs(vm, retained))
+	retainedPVC, err := d.getPVC("test-machine-disk-1")
+	require.NoError(t, err)
+	require.Equal(t, "test-machine", retainedPVC.Labels[retainedFromMachineLabelKey])
+	require.Equal(t, "disk-1", retainedPVC.Annotations[retainedDiskAnnotationKey])
+
+	// the next removal of all the volumes of the cluster keeps both retained
+	// volumes
+	vm.Spec.Template.Spec.Volumes = nil
+	patchedVM, err = d.patchRemovedPVCs(vm, nil, nil)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"test-machine-disk-0", "test-machine-disk-2"},
+		strings.Split(patchedVM.Annotations[harvesterutil.RemovedPVCsAnnotationKey], ","))
+}
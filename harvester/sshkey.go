@@ -0,0 +1,98 @@
+package harvester
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rancher/machine/libmachine/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// sshPublicKeyDataKey holds the public key in the SSH key secret, next to
+// the private key under corev1.SSHAuthPrivateKey.
+const sshPublicKeyDataKey = "ssh-publickey"
+
+func (d *Driver) sshKeySecretName() string {
+	return fmt.Sprintf("%s-%s", d.MachineName, "sshkey")
+}
+
+// restoreSSHKey writes the SSH key generated by an interrupted Create to
+// keyPath, so a retried Create keeps the key the VM may already have booted
+// with. It reports whether a saved key was found.
+func (d *Driver) restoreSSHKey(keyPath string) (bool, error) {
+	secret, err := d.getSecret(d.VMNamespace, d.sshKeySecretName())
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if secret.Annotations[machineNameAnnotationKey] != d.MachineName {
+		return false, fmt.Errorf("secret %s/%s already exists and was not created for machine %s", secret.Namespace, secret.Name, d.MachineName)
+	}
+	if err = os.WriteFile(keyPath, secret.Data[corev1.SSHAuthPrivateKey], 0600); err != nil {
+		return false, err
+	}
+	if err = os.WriteFile(keyPath+".pub", secret.Data[sshPublicKeyDataKey], 0644); err != nil {
+		return false, err
+	}
+	log.Debugf("Using the SSH key saved in secret %s/%s", secret.Namespace, secret.Name)
+	return true, nil
+}
+
+// saveSSHKey saves the SSH key generated at keyPath in a secret, from which
+// a retried Create restores it.
+func (d *Driver) saveSSHKey(keyPath string) error {
+	privateKey, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	publicKey, err := os.ReadFile(keyPath + ".pub")
+	if err != nil {
+		return err
+	}
+	_, err = d.createSecret(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        d.sshKeySecretName(),
+			Namespace:   d.VMNamespace,
+			Annotations: map[string]string{machineNameAnnotationKey: d.MachineName},
+		},
+		Type: corev1.SecretTypeSSHAuth,
+		Data: map[string][]byte{
+			corev1.SSHAuthPrivateKey: privateKey,
+			sshPublicKeyDataKey:      publicKey,
+		},
+	})
+	return err
+}
+
+// adoptSSHKeySecret makes vm the owner of the saved SSH key, so the key is
+// garbage collected with the VM.
+func (d *Driver) adoptSSHKeySecret(vm *kubevirtv1.VirtualMachine) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := d.getSecret(d.VMNamespace, d.sshKeySecretName())
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		for _, ownerReference := range secret.OwnerReferences {
+			if ownerReference.UID == vm.UID {
+				return nil
+			}
+		}
+		secret.OwnerReferences = append(secret.OwnerReferences, metav1.OwnerReference{
+			APIVersion: kubevirtv1.GroupVersion.String(),
+			Kind:       kubevirtv1.VirtualMachineGroupVersionKind.Kind,
+			Name:       vm.Name,
+			UID:        vm.UID,
+		})
+		_, err = d.updateSecret(secret)
+		return err
+	})
+}
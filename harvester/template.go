@@ -0,0 +1,246 @@
+package harvester
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	harvsterv1 "github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
+	"github.com/harvester/harvester/pkg/builder"
+	harvesterutil "github.com/harvester/harvester/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// resolveTemplateVersion returns the version of the template the machine is
+// created from, the default version of the template unless TemplateVersion
+// is set.
+func (d *Driver) resolveTemplateVersion() (*harvsterv1.VirtualMachineTemplateVersion, error) {
+	template, err := d.getTemplate(d.TemplateName)
+	if err != nil {
+		return nil, err
+	}
+	if d.TemplateVersion == 0 {
+		if template.Spec.DefaultVersionID == "" {
+			return nil, fmt.Errorf("template %s/%s has no default version", template.Namespace, template.Name)
+		}
+		namespace, name, err := NamespacedNamePartsByDefault(template.Spec.DefaultVersionID, template.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		return d.getTemplateVersion(namespace, name)
+	}
+	versions, err := d.listTemplateVersions(template.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	templateID := fmt.Sprintf("%s/%s", template.Namespace, template.Name)
+	for i := range versions.Items {
+		if versions.Items[i].Spec.TemplateID == templateID && versions.Items[i].Status.Version == d.TemplateVersion {
+			return &versions.Items[i], nil
+		}
+	}
+	return nil, fmt.Errorf("version %d of template %s not found", d.TemplateVersion, templateID)
+}
+
+// newTemplateVMBuilder returns a VM builder starting from the VM spec of the
+// template version. The disks and network interfaces of the template are
+// dropped when the driver flags provide their own, and the cloud-init of the
+// template is used when the driver flags provide none.
+func (d *Driver) newTemplateVMBuilder() (*builder.VMBuilder, error) {
+	version, err := d.resolveTemplateVersion()
+	if err != nil {
+		return nil, err
+	}
+	if d.UserData == "" || d.NetworkData == "" {
+		userData, networkData, err := d.templateCloudInit(version)
+		if err != nil {
+			return nil, err
+		}
+		if d.UserData == "" {
+			d.UserData = userData
+		}
+		if d.NetworkData == "" {
+			// the network data is validated like the one of the flags, since
+			// it is saved in the driver config
+			if err = checkNetworkData(networkData); err != nil {
+				return nil, fmt.Errorf("invalid network data of template %s: %w", d.TemplateName, err)
+			}
+			d.NetworkData = networkData
+		}
+	}
+	return d.templateVMBuilder(version)
+}
+
+func (d *Driver) templateVMBuilder(version *harvsterv1.VirtualMachineTemplateVersion) (*builder.VMBuilder, error) {
+	vmBuilder := builder.NewVMBuilder(vmCreator)
+	vm := vmBuilder.VirtualMachine
+	defaults := vm.Spec.Template
+	vm.Spec = *version.Spec.VM.Spec.DeepCopy()
+	// the run strategy is set by Create
+	vm.Spec.Running = nil //nolint:staticcheck // templates may still use the deprecated field
+	if vm.Spec.Template == nil {
+		vm.Spec.Template = defaults
+		return vmBuilder, nil
+	}
+
+	// the builder shares the labels of the VM with its pods, which the
+	// machine set affinity relies on
+	vmTemplate := vm.Spec.Template
+	for key, value := range vmTemplate.ObjectMeta.Labels {
+		if _, ok := vm.Labels[key]; !ok {
+			vm.Labels[key] = value
+		}
+	}
+	vmTemplate.ObjectMeta.Labels = defaults.ObjectMeta.Labels
+	if vmTemplate.Spec.Domain.CPU == nil {
+		vmTemplate.Spec.Domain.CPU = defaults.Spec.Domain.CPU
+	}
+	if vmTemplate.Spec.Affinity == nil {
+		vmTemplate.Spec.Affinity = defaults.Spec.Affinity
+	}
+	// the hostname defaults to the machine name
+	vmTemplate.Spec.Hostname = ""
+
+	// the requests and the guest memory are derived from the limits again
+	// when the limits are overridden
+	if d.CPU > 0 {
+		delete(vmTemplate.Spec.Domain.Resources.Requests, corev1.ResourceCPU)
+	}
+	if d.MemorySize != "" {
+		delete(vmTemplate.Spec.Domain.Resources.Requests, corev1.ResourceMemory)
+		vmTemplate.Spec.Domain.Memory = nil
+	}
+
+	if d.overridesTemplateNetworks() {
+		vmTemplate.Spec.Domain.Devices.Interfaces = nil
+		vmTemplate.Spec.Networks = nil
+	} else {
+		// MAC addresses must not be shared by the machines of a template
+		for i := range vmTemplate.Spec.Domain.Devices.Interfaces {
+			vmTemplate.Spec.Domain.Devices.Interfaces[i].MacAddress = ""
+		}
+	}
+
+	if d.overridesTemplateDisks() {
+		vmTemplate.Spec.Domain.Devices.Disks = nil
+		vmTemplate.Spec.Volumes = nil
+		return vmBuilder, nil
+	}
+	if err := d.copyTemplateVolumes(vm, version.Spec.VM.ObjectMeta.Annotations[harvesterutil.AnnotationVolumeClaimTemplates]); err != nil {
+		return nil, err
+	}
+	return vmBuilder, nil
+}
+
+// copyTemplateVolumes gives the volume claims of the template names of the
+// machine, and drops the cloud-init volume of the template, which is
+// replaced by the one of the driver.
+func (d *Driver) copyTemplateVolumes(vm *kubevirtv1.VirtualMachine, volumeClaimTemplates string) error {
+	entries, err := harvesterutil.UnmarshalVolumeClaimTemplates(volumeClaimTemplates)
+	if err != nil {
+		return fmt.Errorf("invalid volume claim templates of template %s: %w", d.TemplateName, err)
+	}
+	claims := make(map[string]*harvesterutil.VolumeClaimTemplateEntry, len(entries))
+	for i := range entries {
+		claims[entries[i].Name] = &entries[i]
+	}
+
+	vmSpec := &vm.Spec.Template.Spec
+	cloudInitVolumes := make(map[string]bool)
+	volumes := vmSpec.Volumes[:0]
+	for _, volume := range vmSpec.Volumes {
+		if volume.CloudInitNoCloud != nil || volume.CloudInitConfigDrive != nil {
+			cloudInitVolumes[volume.Name] = true
+			continue
+		}
+		if volume.PersistentVolumeClaim != nil {
+			if entry, ok := claims[volume.PersistentVolumeClaim.ClaimName]; ok {
+				entry.Name = fmt.Sprintf("%s-%s-%s", d.MachineName, volume.Name, rand.String(5))
+				volume.PersistentVolumeClaim.ClaimName = entry.Name
+			}
+		}
+		volumes = append(volumes, volume)
+	}
+	vmSpec.Volumes = volumes
+	disks := vmSpec.Domain.Devices.Disks[:0]
+	for _, disk := range vmSpec.Domain.Devices.Disks {
+		if !cloudInitVolumes[disk.Name] {
+			disks = append(disks, disk)
+		}
+	}
+	vmSpec.Domain.Devices.Disks = disks
+
+	if len(entries) == 0 {
+		return nil
+	}
+	data, err := harvesterutil.MarshalVolumeClaimTemplates(entries)
+	if err != nil {
+		return err
+	}
+	vm.Annotations[harvesterutil.AnnotationVolumeClaimTemplates] = data
+	return nil
+}
+
+// templateCloudInit returns the cloud-init user data and network data of
+// the template version.
+func (d *Driver) templateCloudInit(version *harvsterv1.VirtualMachineTemplateVersion) (string, string, error) {
+	vmTemplate := version.Spec.VM.Spec.Template
+	if vmTemplate == nil {
+		return "", "", nil
+	}
+	for _, volume := range vmTemplate.Spec.Volumes {
+		source := volume.CloudInitNoCloud
+		if source == nil {
+			continue
+		}
+		userData, err := d.templateCloudInitData(version.Namespace, source.UserData, source.UserDataBase64, source.UserDataSecretRef, "userdata")
+		if err != nil {
+			return "", "", err
+		}
+		networkData, err := d.templateCloudInitData(version.Namespace, source.NetworkData, source.NetworkDataBase64, source.NetworkDataSecretRef, "networkdata")
+		if err != nil {
+			return "", "", err
+		}
+		return userData, networkData, nil
+	}
+	return "", "", nil
+}
+
+func (d *Driver) templateCloudInitData(namespace, data, dataBase64 string, secretRef *corev1.LocalObjectReference, secretKey string) (string, error) {
+	switch {
+	case secretRef != nil:
+		secret, err := d.getSecret(namespace, secretRef.Name)
+		if err != nil {
+			return "", err
+		}
+		return string(secret.Data[secretKey]), nil
+	case dataBase64 != "":
+		decoded, err := base64.StdEncoding.DecodeString(dataBase64)
+		if err != nil {
+			return "", err
+		}
+		return string(decoded), nil
+	default:
+		return data, nil
+	}
+}
+
+// overridesTemplateDisks reports whether the driver flags provide the disks
+// of the machine in place of the disks of the template.
+func (d *Driver) overridesTemplateDisks() bool {
+	return d.DiskInfo != nil || d.ImageName != "" || d.RestoreFrom != ""
+}
+
+// overridesTemplateNetworks reports whether the driver flags provide the
+// network interfaces of the machine in place of those of the template.
+func (d *Driver) overridesTemplateNetworks() bool {
+	return d.NetworkInfo != nil || d.NetworkName != ""
+}
+
+// usesImageFlags reports whether the machine disk is created from the image
+// name and disk size flags, which is the case unless the disks come from a
+// backup or a template.
+func (d *Driver) usesImageFlags() bool {
+	return d.RestoreFrom == "" && (d.TemplateName == "" || d.ImageName != "")
+}
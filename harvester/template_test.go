@@ -0,0 +1,142 @@
+package harvester
+
+import (
+	"strings"
+	"testing"
+
+	harvsterv1 "github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
+	"github.com/harvester/harvester/pkg/builder"
+	harvesterutil "github.com/harvester/harvester/pkg/util"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func testTemplateVersion(t *testing.T) *harvsterv1.VirtualMachineTemplateVersion {
+	volumeClaimTemplates, err := harvesterutil.MarshalVolumeClaimTemplates([]harvesterutil.VolumeClaimTemplateEntry{
+		{PersistentVolumeClaim: corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "-disk-0-abcde"}}},
+	})
+	require.NoError(t, err)
+	return &harvsterv1.VirtualMachineTemplateVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "ubuntu-v1", Namespace: "default"},
+		Spec: harvsterv1.VirtualMachineTemplateVersionSpec{
+			TemplateID: "default/ubuntu",
+			VM: harvsterv1.VirtualMachineSourceSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{harvesterutil.AnnotationVolumeClaimTemplates: volumeClaimTemplates},
+				},
+				Spec: kubevirtv1.VirtualMachineSpec{
+					Running: ptr.To(true),
+					Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"team": "platform"}},
+						Spec: kubevirtv1.VirtualMachineInstanceSpec{
+							Hostname: "template-host",
+							Domain: kubevirtv1.DomainSpec{
+								CPU: &kubevirtv1.CPU{Cores: 4, Sockets: 1, Threads: 1},
+								Devices: kubevirtv1.Devices{
+									Disks: []kubevirtv1.Disk{{Name: "disk-0"}, {Name: "cloudinitdisk"}},
+									Interfaces: []kubevirtv1.Interface{
+										{Name: "default", MacAddress: "52:54:00:00:00:01"},
+									},
+								},
+							},
+							Networks: []kubevirtv1.Network{{Name: "default"}},
+							Volumes: []kubevirtv1.Volume{
+								{
+									Name: "disk-0",
+									VolumeSource: kubevirtv1.VolumeSource{
+										PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
+											PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{ClaimName: "-disk-0-abcde"},
+										},
+									},
+								},
+								{
+									Name: "cloudinitdisk",
+									VolumeSource: kubevirtv1.VolumeSource{
+										CloudInitNoCloud: &kubevirtv1.CloudInitNoCloudSource{
+											UserData:    "#cloud-config\npackages:\n- vim\n",
+											NetworkData: "version: 2\n",
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestTemplateVMBuilder(t *testing.T) {
+	d := NewDriver("test-machine", "")
+	d.TemplateName = "ubuntu"
+	version := testTemplateVersion(t)
+
+	vmBuilder, err := d.templateVMBuilder(version)
+	require.NoError(t, err)
+	vm, err := vmBuilder.Name(d.MachineName).VM()
+	require.NoError(t, err)
+
+	require.Nil(t, vm.Spec.Running)
+	require.Empty(t, vm.Spec.Template.Spec.Hostname)
+	require.Equal(t, uint32(4), vm.Spec.Template.Spec.Domain.CPU.Cores)
+	require.Equal(t, "platform", vm.Spec.Template.ObjectMeta.Labels["team"])
+	require.Equal(t, vmCreator, vm.Spec.Template.ObjectMeta.Labels[builder.LabelKeyVirtualMachineCreator])
+	require.Empty(t, vm.Spec.Template.Spec.Domain.Devices.Interfaces[0].MacAddress)
+
+	// the cloud-init disk is replaced by the one of the driver
+	require.Equal(t, []kubevirtv1.Disk{{Name: "disk-0"}}, vm.Spec.Template.Spec.Domain.Devices.Disks)
+	require.Len(t, vm.Spec.Template.Spec.Volumes, 1)
+	claimName := vm.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName
+	require.True(t, strings.HasPrefix(claimName, "test-machine-disk-0-"), claimName)
+	entries, err := harvesterutil.UnmarshalVolumeClaimTemplates(vm.Annotations[harvesterutil.AnnotationVolumeClaimTemplates])
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, claimName, entries[0].Name)
+
+	// the template itself is left untouched
+	require.Equal(t, "52:54:00:00:00:01", version.Spec.VM.Spec.Template.Spec.Domain.Devices.Interfaces[0].MacAddress)
+}
+
+func TestTemplateVMBuilderOverrides(t *testing.T) {
+	d := NewDriver("test-machine", "")
+	d.TemplateName = "ubuntu"
+	d.ImageName = "default/image"
+	d.NetworkName = "default/vlan1"
+
+	vmBuilder, err := d.templateVMBuilder(testTemplateVersion(t))
+	require.NoError(t, err)
+	vm := vmBuilder.VirtualMachine
+	require.Empty(t, vm.Spec.Template.Spec.Domain.Devices.Disks)
+	require.Empty(t, vm.Spec.Template.Spec.Volumes)
+	require.Empty(t, vm.Spec.Template.Spec.Domain.Devices.Interfaces)
+	require.Empty(t, vm.Spec.Template.Spec.Networks)
+	require.NotContains(t, vm.Annotations, harvesterutil.AnnotationVolumeClaimTemplates)
+}
+
+func TestTemplateCloudInit(t *testing.T) {
+	d := NewDriver("test-machine", "")
+	userData, networkData, err := d.templateCloudInit(testTemplateVersion(t))
+	require.NoError(t, err)
+	require.Equal(t, "#cloud-config\npackages:\n- vim\n", userData)
+	require.Equal(t, "version: 2\n", networkData)
+}
+
+func TestSetSize(t *testing.T) {
+	d := NewDriver("test-machine", "")
+	d.setSize(0, 0)
+	require.Equal(t, defaultCPU, d.CPU)
+	require.Equal(t, "4Gi", d.MemorySize)
+
+	// with a template, values equal to the defaults are still provided values
+	d.TemplateName = "default/template"
+	d.setSize(defaultCPU, defaultMemorySize)
+	require.Equal(t, defaultCPU, d.CPU)
+	require.Equal(t, "4Gi", d.MemorySize)
+	d.setSize(0, 0)
+	require.Zero(t, d.CPU)
+	require.Empty(t, d.MemorySize)
+}
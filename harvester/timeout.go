@@ -0,0 +1,68 @@
+package harvester
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	operationCreate     = "create"
+	operationStart      = "start"
+	operationStop       = "stop"
+	operationRestart    = "restart"
+	operationRemove     = "remove"
+	operationKill       = "kill"
+	operationPause      = "pause"
+	operationUnpause    = "unpause"
+	operationMigrate    = "migrate"
+	operationResize     = "resize"
+	operationExpandDisk = "expand a disk of"
+	operationBackup     = "back up"
+
+	operationAddVolume    = "add a volume to"
+	operationRemoveVolume = "remove a volume from"
+)
+
+// operationTimeout converts a timeout in seconds from the driver config,
+// falling back to the default for configs saved before it was configurable.
+func operationTimeout(seconds int) time.Duration {
+	if seconds <= 0 {
+		return defaultOperationTimeout * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// withTimeout runs fn with d.ctx bounded by timeout, so every client call and
+// wait made by fn honors the operation deadline.
+func (d *Driver) withTimeout(operation string, seconds int, fn func() error) error {
+	timeout := operationTimeout(seconds)
+	parent := d.ctx
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	d.ctx = ctx
+	defer func() {
+		cancel()
+		d.ctx = parent
+	}()
+
+	err := fn()
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s machine %s timed out after %s: %w", operation, d.MachineName, timeout, err)
+	}
+	return err
+}
+
+// withDetachedContext runs fn with d.ctx replaced by a context that is not
+// canceled with the current operation, for cleanup that has to happen after
+// the operation deadline passed.
+func (d *Driver) withDetachedContext(timeout time.Duration, fn func()) {
+	parent := d.ctx
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(parent), timeout)
+	d.ctx = ctx
+	defer func() {
+		cancel()
+		d.ctx = parent
+	}()
+	fn()
+}
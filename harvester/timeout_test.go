@@ -0,0 +1,33 @@
+package harvester
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOperationTimeout(t *testing.T) {
+	require.Equal(t, 10*time.Minute, operationTimeout(0))
+	require.Equal(t, 90*time.Second, operationTimeout(90))
+}
+
+func TestWithTimeout(t *testing.T) {
+	d := NewDriver("test-machine", "")
+	parent := d.ctx
+
+	err := d.withTimeout(operationStop, 1, func() error {
+		<-d.ctx.Done()
+		return d.ctx.Err()
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.EqualError(t, err, "stop machine test-machine timed out after 1s: context deadline exceeded")
+	require.Equal(t, parent, d.ctx, "the driver context must be restored")
+
+	require.NoError(t, d.withTimeout(operationStart, 1, func() error {
+		_, ok := d.ctx.Deadline()
+		require.True(t, ok)
+		return nil
+	}))
+}
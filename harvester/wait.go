@@ -0,0 +1,149 @@
+package harvester
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rancher/machine/libmachine/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	defaultWaitTimeout = 10 * time.Minute
+	// waitResyncPeriod is how often a wait re-checks its condition even when
+	// no watch event has been received, in case an event was missed.
+	waitResyncPeriod = 30 * time.Second
+	// waitPollInterval is used in place of watch events while a watch cannot
+	// be established.
+	waitPollInterval = 5 * time.Second
+)
+
+type watchFunc func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error)
+
+// watchTarget is an object whose changes trigger the evaluation of a wait.
+type watchTarget struct {
+	kind    string
+	name    string
+	watchFn watchFunc
+}
+
+// waitFor blocks until done returns true or d.ctx is done. done is evaluated
+// immediately and then again every time the machine's VirtualMachine or
+// VirtualMachineInstance changes.
+func (d *Driver) waitFor(desc string, done func() (bool, error)) error {
+	c, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	return d.waitForTargets(desc, done, []watchTarget{
+		{kind: "vm", name: d.MachineName, watchFn: c.HarvesterClient.KubevirtV1().VirtualMachines(d.VMNamespace).Watch},
+		{kind: "vmi", name: d.MachineName, watchFn: c.HarvesterClient.KubevirtV1().VirtualMachineInstances(d.VMNamespace).Watch},
+	})
+}
+
+// waitForTargets is like waitFor, but evaluates done whenever one of targets
+// changes.
+func (d *Driver) waitForTargets(desc string, done func() (bool, error), targets []watchTarget) error {
+	ctx, cancel := d.ctx, context.CancelFunc(func() {})
+	if _, ok := ctx.Deadline(); !ok {
+		ctx, cancel = context.WithTimeout(ctx, defaultWaitTimeout)
+	}
+	defer cancel()
+
+	events := make(chan struct{}, 1)
+	for _, target := range targets {
+		go watchEvents(ctx, target.kind, target.name, target.watchFn, events)
+	}
+	return waitForEvents(ctx, desc, events, done)
+}
+
+// waitForEvents evaluates done once and then on every notification received
+// from events, and at least every waitResyncPeriod.
+func waitForEvents(ctx context.Context, desc string, events <-chan struct{}, done func() (bool, error)) error {
+	resync := time.NewTicker(waitResyncPeriod)
+	defer resync.Stop()
+
+	var lastErr error
+	for {
+		ok, err := done()
+		if ok {
+			return nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return fmt.Errorf("timed out waiting for %s: %w.  Last error: %s", desc, ctx.Err(), lastErr)
+			}
+			return fmt.Errorf("timed out waiting for %s: %w", desc, ctx.Err())
+		case <-events:
+		case <-resync.C:
+		}
+	}
+}
+
+// watchEvents watches the object with the given name and sends a notification
+// to events for every change. If the watch cannot be established or is closed
+// by the server it is re-established, and notifications are sent every
+// waitPollInterval in the meantime so that waiting degrades to polling.
+func watchEvents(ctx context.Context, kind, name string, watchFn watchFunc, events chan<- struct{}) {
+	opts := metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String(),
+	}
+	for ctx.Err() == nil {
+		w, err := watchFn(ctx, opts)
+		if err != nil {
+			log.Debugf("Failed to watch %s %s, falling back to polling: %v", kind, name, err)
+			notify(events)
+			select {
+			case <-ctx.Done():
+			case <-time.After(waitPollInterval):
+			}
+			continue
+		}
+		// the object may have changed before the watch was established
+		notify(events)
+		failed := consumeEvents(ctx, w, events)
+		w.Stop()
+		if failed {
+			log.Debugf("Watch on %s %s failed, re-establishing", kind, name)
+			select {
+			case <-ctx.Done():
+			case <-time.After(waitPollInterval):
+			}
+		}
+	}
+}
+
+// consumeEvents forwards events from w until it is closed, and reports
+// whether it ended with an error event.
+func consumeEvents(ctx context.Context, w watch.Interface, events chan<- struct{}) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return false
+			}
+			if event.Type == watch.Error {
+				return true
+			}
+			notify(events)
+		}
+	}
+}
+
+// notify sends a notification without blocking; a pending notification is
+// enough to trigger the next evaluation.
+func notify(events chan<- struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,73 @@
+package harvester
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func TestWaitForEvents(t *testing.T) {
+	fakeWatcher := watch.NewFake()
+	watchFn := func(_ context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+		require.Equal(t, "metadata.name=test-machine", opts.FieldSelector)
+		return fakeWatcher, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events := make(chan struct{}, 1)
+	go watchEvents(ctx, "vm", "test-machine", watchFn, events)
+
+	var checks, ready atomic.Int32
+	done := func() (bool, error) {
+		checks.Add(1)
+		return ready.Load() == 1, nil
+	}
+	go func() {
+		// the first event is delivered once the watch is consumed
+		fakeWatcher.Add(&kubevirtv1.VirtualMachine{})
+		ready.Store(1)
+		fakeWatcher.Modify(&kubevirtv1.VirtualMachine{})
+	}()
+
+	require.NoError(t, waitForEvents(ctx, "test", events, done))
+	require.GreaterOrEqual(t, checks.Load(), int32(2))
+}
+
+func TestWaitForEventsTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := func() (bool, error) {
+		return false, errors.New("not ready")
+	}
+	err := waitForEvents(ctx, "machine to be Running", make(chan struct{}), done)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorContains(t, err, "timed out waiting for machine to be Running")
+	require.ErrorContains(t, err, "not ready")
+}
+
+func TestWatchEventsFallbackToPolling(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	watchFn := func(context.Context, metav1.ListOptions) (watch.Interface, error) {
+		return nil, errors.New("watch is forbidden")
+	}
+	events := make(chan struct{}, 1)
+	go watchEvents(ctx, "vmi", "test-machine", watchFn, events)
+
+	select {
+	case <-events:
+	case <-ctx.Done():
+		t.Fatal("expected a notification when the watch cannot be established")
+	}
+}
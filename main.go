@@ -1,11 +1,24 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/rancher/machine/libmachine/drivers/plugin"
+	"github.com/rancher/machine/libmachine/drivers/plugin/localbinary"
 
 	"github.com/harvester/docker-machine-driver-harvester/harvester"
 )
 
 func main() {
+	// rancher-machine passes its own arguments to the plugin, so they are
+	// only commands when the binary is not run as a plugin
+	if os.Getenv(localbinary.PluginEnvKey) != localbinary.PluginEnvVal && len(os.Args) > 1 {
+		if err := harvester.RunCommand(os.Args[1:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	plugin.RegisterDriver(harvester.NewDriver("machine", ""))
 }